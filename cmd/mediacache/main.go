@@ -1,46 +1,87 @@
 package main
 
 import (
+	"encoding/json"
+	"flag"
+	"fmt"
 	"log"
-	"strings"
-	"sync"
-)
-
-const (
-	SOFTWARE   = "MediaCache"
-	VERSION    = "v1.0+kopper1"
-	GITHUB_URL = "https://github.com/ShittyKopper/mediacache"
-)
+	"os"
 
-var (
-	listen    = getEnv("CACHE_LISTEN", ":3333")
-	cacheDir  = getEnv("CACHE_DIR", "./cache")
-	upstreams = strings.Split(getEnv("CACHE_UPSTREAM", "https://example.com"), " ")
-	prefix    = getEnv("CACHE_PREFIX", "/")
-	reply404  = getEnv("CACHE_REPLY_404", "")
-	reply403  = getEnv("CACHE_REPLY_403", "")
-	reply500  = getEnv("CACHE_REPLY_500", "")
-	reply503  = getEnv("CACHE_REPLY_503", "")
-	reply504  = getEnv("CACHE_REPLY_504", "")
-
-	printStats = getEnv("CACHE_PRINT_STATS", true)
-
-	maxCacheFiles = getEnv[int64]("CACHE_MAX_FILES", 10_000)
-	maxCacheSize  = float64(getEnv[int64]("CACHE_MAX_SIZE_MB", 1_000))
-	maxAge        = float64(getEnv[int64]("CACHE_MAX_AGE_HOURS", 3))
-	cacheClean    = getEnv("CACHE_CLEAN", true)
-	dryRun        = getEnv("CACHE_DRY_RUN", false)
-
-	locks = make(map[string]*lockable)
-	mutex = &sync.RWMutex{}
+	"git.hajkey.org/hajkey/mediacache/pkg/mediacache"
 )
 
 func main() {
-	log.Printf("listening on %s", listen)
-	log.Printf("upstreams: %s", strings.Join(upstreams, ", "))
-	log.Printf("cache dir: %s", cacheDir)
-	log.Printf("prefix: %s", prefix)
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "convert-meta":
+			if len(os.Args) != 3 {
+				fmt.Fprintln(os.Stderr, "usage: mediacache convert-meta json|gob")
+				os.Exit(2)
+			}
+			err := mediacache.ConvertMeta(os.Args[2])
+			if err != nil {
+				log.Fatal(err)
+			}
+			return
+		case "hash-token":
+			if len(os.Args) != 3 {
+				fmt.Fprintln(os.Stderr, "usage: mediacache hash-token <token>")
+				os.Exit(2)
+			}
+			fmt.Println(mediacache.HashToken(os.Args[2]))
+			return
+		case "export-list":
+			if len(os.Args) != 4 {
+				fmt.Fprintln(os.Stderr, "usage: mediacache export-list blocklist|pins json|csv")
+				os.Exit(2)
+			}
+			err := mediacache.ExportList(os.Args[2], os.Args[3], os.Stdout)
+			if err != nil {
+				log.Fatal(err)
+			}
+			return
+		case "import-list":
+			importList(os.Args[2:])
+			return
+		default:
+			log.Fatalf("unknown command: %s", os.Args[1])
+		}
+	}
+
+	cache, err := mediacache.New(mediacache.Config{})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = cache.ListenAndServe()
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func importList(args []string) {
+	flags := flag.NewFlagSet("import-list", flag.ExitOnError)
+	replace := flags.Bool("replace", false, "replace the list instead of merging into it")
+	dryRun := flags.Bool("dry-run", false, "only report what would change")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: mediacache import-list [-replace] [-dry-run] blocklist|pins json|csv <file>")
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+	if flags.NArg() != 3 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	file, err := os.Open(flags.Arg(2))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer file.Close()
 
-	go maintain()
-	serve()
+	result, err := mediacache.ImportList(flags.Arg(0), flags.Arg(1), file, *replace, *dryRun)
+	if err != nil {
+		log.Fatal(err)
+	}
+	_ = json.NewEncoder(os.Stdout).Encode(result)
 }
@@ -0,0 +1,83 @@
+// Package cachekey maps requests to the keys objects are cached under, and
+// keys to the names objects are stored by.
+package cachekey
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Policy is how the query string takes part in a key:
+//
+//   - include: all parameters, sorted so their order doesn't matter
+//   - ignore: none, every query maps to the same object
+//   - allowlist: only the parameters in Allowlist
+//
+// Upstreams always get the query as the client sent it, so signed URLs keep
+// working even when their signature isn't part of the key.
+type Policy struct {
+	Query     string
+	Allowlist []string
+}
+
+// Key returns the key an object is cached under.
+func (p Policy) Key(path string, rawQuery string) string {
+	if rawQuery == "" || p.Query == "ignore" {
+		return path
+	}
+
+	values, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		// Can't normalize it, so keep it exactly as it was
+		return path + "?" + rawQuery
+	}
+
+	if p.Query == "allowlist" {
+		allowed := make(url.Values)
+		for _, param := range p.Allowlist {
+			if value, ok := values[param]; ok {
+				allowed[param] = value
+			}
+		}
+		values = allowed
+	}
+
+	// Encode sorts by parameter name
+	query := values.Encode()
+	if query == "" {
+		return path
+	}
+	return path + "?" + query
+}
+
+// ForPath returns the key for a path as given to the admin API, which may
+// include a query string. The path may be percent-encoded the way it
+// appears in URLs; keys always use the decoded form.
+func (p Policy) ForPath(rawPath string) string {
+	path, rawQuery, _ := strings.Cut(rawPath, "?")
+	if unescaped, err := url.PathUnescape(path); err == nil {
+		path = unescaped
+	}
+	return p.Key(path, rawQuery)
+}
+
+// UpstreamPath is what gets requested from the upstreams for r. It keeps
+// the path encoded, so names containing "%", "?" or "#" reach the upstream
+// exactly as the client sent them.
+func UpstreamPath(r *http.Request) string {
+	if r.URL.RawQuery == "" {
+		return r.URL.EscapedPath()
+	}
+	return r.URL.EscapedPath() + "?" + r.URL.RawQuery
+}
+
+// Hash returns the name an object with the given key is stored by.
+func Hash(key string) string {
+	sha := sha256.New()
+	sha.Write([]byte(key))
+	encoded := base64.URLEncoding.EncodeToString(sha.Sum(nil))
+	return strings.ReplaceAll(encoded, "=", "")
+}
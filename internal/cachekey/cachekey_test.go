@@ -0,0 +1,57 @@
+package cachekey
+
+import "testing"
+
+func TestKey(t *testing.T) {
+	include := Policy{Query: "include"}
+	ignore := Policy{Query: "ignore"}
+	allowlist := Policy{Query: "allowlist", Allowlist: []string{"w", "h"}}
+
+	tests := []struct {
+		name     string
+		policy   Policy
+		rawQuery string
+		want     string
+	}{
+		{"no query", include, "", "/a.png"},
+		{"sorted", include, "w=400&h=300", "/a.png?h=300&w=400"},
+		{"same order", include, "h=300&w=400", "/a.png?h=300&w=400"},
+		{"repeated kept in order", include, "b=2&a=1&b=1", "/a.png?a=1&b=2&b=1"},
+		{"reencoded", include, "q=a%20b+c", "/a.png?q=a+b+c"},
+		{"empty value", include, "dl", "/a.png?dl="},
+		{"unparsable kept as is", include, "q=%zz&a=1", "/a.png?q=%zz&a=1"},
+		{"ignored", ignore, "w=400&h=300", "/a.png"},
+		{"allowlisted", allowlist, "sig=abc&w=400&h=300", "/a.png?h=300&w=400"},
+		{"none allowlisted", allowlist, "sig=abc&expires=1", "/a.png"},
+		{"allowlist is case sensitive", allowlist, "W=400", "/a.png"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.Key("/a.png", tt.rawQuery); got != tt.want {
+				t.Errorf("Key() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestForPath(t *testing.T) {
+	policy := Policy{Query: "include"}
+
+	tests := []struct {
+		rawPath string
+		want    string
+	}{
+		{"/a.png", "/a.png"},
+		{"/a%20b.png", "/a b.png"},
+		{"/a%3Fb.png?w=1", "/a?b.png?w=1"},
+		{"/a.png?w=400&h=300", "/a.png?h=300&w=400"},
+		{"/100%.png", "/100%.png"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.rawPath, func(t *testing.T) {
+			if got := policy.ForPath(tt.rawPath); got != tt.want {
+				t.Errorf("ForPath() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
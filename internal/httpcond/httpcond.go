@@ -0,0 +1,146 @@
+// Package httpcond evaluates the conditional and range headers of requests
+// for cached objects, following RFC 9110.
+package httpcond
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrorStr is an error that can be a constant.
+type ErrorStr string
+
+func (e ErrorStr) Error() string {
+	return string(e)
+}
+
+// ErrRangeNotSatisfiable is a Range that doesn't overlap the object at all.
+const ErrRangeNotSatisfiable = ErrorStr("range not satisfiable")
+
+// Conditions are the conditional headers of a request.
+type Conditions struct {
+	NoneMatch     []string
+	AnyMatch      bool
+	ModifiedSince time.Time
+	IfRange       string
+}
+
+// Parse reads If-None-Match, If-Modified-Since and If-Range. Dates that
+// don't parse are ignored, as if the header wasn't there.
+func Parse(r *http.Request) Conditions {
+	var c Conditions
+	for _, tag := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		tag = strings.TrimSpace(tag)
+		switch tag {
+		case "":
+		case "*":
+			c.AnyMatch = true
+		default:
+			c.NoneMatch = append(c.NoneMatch, tag)
+		}
+	}
+	if m := r.Header.Get("If-Modified-Since"); m != "" {
+		c.ModifiedSince, _ = http.ParseTime(m)
+	}
+	c.IfRange = strings.TrimSpace(r.Header.Get("If-Range"))
+	return c
+}
+
+// NotModified tells whether an object with the given ETag and Last-Modified
+// date can be answered with 304. If-None-Match takes precedence over
+// If-Modified-Since, and compares weakly.
+func (c Conditions) NotModified(eTag string, lastModified time.Time) bool {
+	if c.AnyMatch {
+		return true
+	}
+	if len(c.NoneMatch) > 0 {
+		for _, tag := range c.NoneMatch {
+			if eTag != "" && weak(tag) == weak(eTag) {
+				return true
+			}
+		}
+		return false
+	}
+	return !c.ModifiedSince.IsZero() && !lastModified.IsZero() &&
+		!lastModified.Truncate(time.Second).After(c.ModifiedSince)
+}
+
+// RangeApplies tells whether a Range should be honoured. If-Range needs a
+// strong ETag or the exact Last-Modified date, else the whole object is
+// sent.
+func (c Conditions) RangeApplies(eTag string, lastModified time.Time) bool {
+	if c.IfRange == "" {
+		return true
+	}
+	if strings.HasPrefix(c.IfRange, `"`) {
+		return eTag != "" && !strings.HasPrefix(eTag, "W/") && c.IfRange == eTag
+	}
+	date, err := http.ParseTime(c.IfRange)
+	return err == nil && !lastModified.IsZero() && lastModified.Truncate(time.Second).Equal(date)
+}
+
+func weak(tag string) string {
+	return strings.TrimPrefix(tag, "W/")
+}
+
+// Range is a byte range of an object, end included.
+type Range struct {
+	Start  int64
+	End    int64
+	Length int64
+}
+
+// ParseRange parses a single "bytes=start-end", "bytes=start-" or
+// "bytes=-suffix" range for an object of the given size. Anything else,
+// including multiple ranges, returns nil so the whole object is sent.
+func ParseRange(rangeHeader string, fileSize int64) (*Range, error) {
+	rangeStr, ok := strings.CutPrefix(rangeHeader, "bytes=")
+	if !ok || strings.Contains(rangeStr, ",") {
+		return nil, nil
+	}
+
+	// Split into start and end
+	first, last, ok := strings.Cut(strings.TrimSpace(rangeStr), "-")
+	if !ok || (first == "" && last == "") {
+		return nil, nil
+	}
+
+	var start, end int64
+	if first == "" {
+		// The last n bytes
+		suffix, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || suffix < 0 {
+			return nil, nil
+		}
+		if suffix == 0 || fileSize == 0 {
+			return nil, ErrRangeNotSatisfiable
+		}
+		start = max(fileSize-suffix, 0)
+		end = fileSize - 1
+	} else {
+		var err error
+		start, err = strconv.ParseInt(first, 10, 64)
+		if err != nil || start < 0 {
+			return nil, nil
+		}
+		end = fileSize - 1
+		if last != "" {
+			end, err = strconv.ParseInt(last, 10, 64)
+			if err != nil || end < start {
+				return nil, nil
+			}
+			end = min(end, fileSize-1)
+		}
+		if start >= fileSize {
+			return nil, ErrRangeNotSatisfiable
+		}
+	}
+
+	return &Range{
+		Start:  start,
+		End:    end,
+		Length: end - start + 1,
+	}, nil
+}
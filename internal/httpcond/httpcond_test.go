@@ -0,0 +1,121 @@
+package httpcond
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+var lastModified = time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+func conditions(headers ...string) Conditions {
+	r := httptest.NewRequest("GET", "/a.png", nil)
+	for i := 0; i < len(headers); i += 2 {
+		r.Header.Set(headers[i], headers[i+1])
+	}
+	return Parse(r)
+}
+
+func TestNotModified(t *testing.T) {
+	tests := []struct {
+		name    string
+		eTag    string
+		headers []string
+		want    bool
+	}{
+		{"no conditions", `"v1"`, nil, false},
+		{"matching etag", `"v1"`, []string{"If-None-Match", `"v1"`}, true},
+		{"other etag", `"v1"`, []string{"If-None-Match", `"v2"`}, false},
+		{"mixed list", `"v1"`, []string{"If-None-Match", `"v2", W/"v1"`}, true},
+		{"weak object", `W/"v1"`, []string{"If-None-Match", `"v1"`}, true},
+		{"any", `"v1"`, []string{"If-None-Match", "*"}, true},
+		{"no object etag", "", []string{"If-None-Match", `""`}, false},
+		{"same date", `"v1"`, []string{"If-Modified-Since", "Thu, 01 Jan 2026 12:00:00 GMT"}, true},
+		{"later date", `"v1"`, []string{"If-Modified-Since", "Fri, 02 Jan 2026 12:00:00 GMT"}, true},
+		{"earlier date", `"v1"`, []string{"If-Modified-Since", "Wed, 31 Dec 2025 12:00:00 GMT"}, false},
+		{"asctime date", `"v1"`, []string{"If-Modified-Since", "Thu Jan  1 12:00:00 2026"}, true},
+		{"invalid date", `"v1"`, []string{"If-Modified-Since", "yesterday"}, false},
+		{
+			"etag takes precedence",
+			`"v1"`,
+			[]string{"If-None-Match", `"v2"`, "If-Modified-Since", "Fri, 02 Jan 2026 12:00:00 GMT"},
+			false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := conditions(tt.headers...).NotModified(tt.eTag, lastModified)
+			if got != tt.want {
+				t.Errorf("NotModified() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNotModifiedSubsecond(t *testing.T) {
+	c := conditions("If-Modified-Since", "Thu, 01 Jan 2026 12:00:00 GMT")
+	if !c.NotModified("", lastModified.Add(500*time.Millisecond)) {
+		t.Error("dates within the same second should count as unmodified")
+	}
+}
+
+func TestRangeApplies(t *testing.T) {
+	tests := []struct {
+		name    string
+		eTag    string
+		ifRange string
+		want    bool
+	}{
+		{"no If-Range", `"v1"`, "", true},
+		{"matching etag", `"v1"`, `"v1"`, true},
+		{"other etag", `"v1"`, `"v2"`, false},
+		{"weak etag", `W/"v1"`, `W/"v1"`, false},
+		{"weak object", `W/"v1"`, `"v1"`, false},
+		{"same date", `"v1"`, "Thu, 01 Jan 2026 12:00:00 GMT", true},
+		{"later date", `"v1"`, "Fri, 02 Jan 2026 12:00:00 GMT", false},
+		{"invalid date", `"v1"`, "yesterday", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := conditions("If-Range", tt.ifRange).RangeApplies(tt.eTag, lastModified)
+			if got != tt.want {
+				t.Errorf("RangeApplies() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		header string
+		size   int64
+		want   *Range
+		err    error
+	}{
+		{"", 10, nil, nil},
+		{"bytes=2-4", 10, &Range{2, 4, 3}, nil},
+		{"bytes=7-", 10, &Range{7, 9, 3}, nil},
+		{"bytes=5-100", 10, &Range{5, 9, 5}, nil},
+		{"bytes=-3", 10, &Range{7, 9, 3}, nil},
+		{"bytes=-30", 10, &Range{0, 9, 10}, nil},
+		{"bytes=10-", 10, nil, ErrRangeNotSatisfiable},
+		{"bytes=-0", 10, nil, ErrRangeNotSatisfiable},
+		{"bytes=0-", 0, nil, ErrRangeNotSatisfiable},
+		{"bytes=0-1,4-5", 10, nil, nil},
+		{"bytes=4-2", 10, nil, nil},
+		{"bytes=a-b", 10, nil, nil},
+		{"bytes=-", 10, nil, nil},
+		{"items=0-1", 10, nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			got, err := ParseRange(tt.header, tt.size)
+			if err != tt.err {
+				t.Fatalf("ParseRange() error = %v, want %v", err, tt.err)
+			}
+			if (got == nil) != (tt.want == nil) || (got != nil && *got != *tt.want) {
+				t.Errorf("ParseRange() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
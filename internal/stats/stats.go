@@ -0,0 +1,94 @@
+// Package stats counts requests and transfers, for the whole cache or a
+// part of it like an object or a route.
+package stats
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Logger is where Report writes.
+var Logger = log.Default()
+
+// Stats are the counters of one part of the cache, reported under Name.
+type Stats struct {
+	Name          string
+	Requests      uint64
+	Completed     uint64
+	Disconnects   uint64
+	SentBytes     uint64
+	ReceivedBytes uint64
+
+	Hits      uint64
+	HitBytes  uint64
+	Misses    uint64
+	MissBytes uint64
+	Errors    uint64
+	SlowReads uint64
+	Corrupt   uint64
+	Limited   uint64
+	MemHits   uint64
+	DiskHits  uint64
+	Abandoned uint64
+
+	DigestFailures uint64
+	Quarantined    uint64
+	BadSignatures  uint64
+}
+
+func (s *Stats) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]uint64{
+		"requests":      s.Requests,
+		"completed":     s.Completed,
+		"disconnects":   s.Disconnects,
+		"sentBytes":     s.SentBytes,
+		"receivedBytes": s.ReceivedBytes,
+		"hits":          s.Hits,
+		"hitBytes":      s.HitBytes,
+		"misses":        s.Misses,
+		"missBytes":     s.MissBytes,
+		"errors":        s.Errors,
+		"slowReads":     s.SlowReads,
+		"corrupt":       s.Corrupt,
+		"limited":       s.Limited,
+		"memHits":       s.MemHits,
+		"diskHits":      s.DiskHits,
+		"abandoned":     s.Abandoned,
+
+		"digestFailures": s.DigestFailures,
+		"quarantined":    s.Quarantined,
+		"badSignatures":  s.BadSignatures,
+	})
+}
+
+// Report logs the counters, with extra appended to the name.
+func (s *Stats) Report(extra ...string) {
+	rate := fmt.Sprintf("%3.1f×", float64(s.Hits)/float64(s.Misses))
+	if s.Misses == 0 {
+		rate = "∞"
+	}
+
+	sentMB := float64(s.SentBytes) / 1024 / 1024
+	receivedMB := float64(s.ReceivedBytes) / 1024 / 1024
+	transferRate := fmt.Sprintf("%3.01f×", sentMB/receivedMB)
+	if receivedMB == 0 {
+		transferRate = "∞"
+	}
+
+	Logger.Printf(
+		"%s%s\n"+
+			"req: %6d/%-6d  %3d dc  %3d ab  hit %6d:%-6d %-6s  mem: %d/%d  err: %d  slow: %d  corrupt: %d  digest: %d  quarantined: %d  limited: %d  bad sig: %d\n"+
+			"sent: %8.01fMB  recv: %8.01fMB %s",
+		s.Name,
+		strings.Join(extra, ""),
+		s.Completed, s.Requests, s.Disconnects, s.Abandoned,
+		s.Hits, s.Misses, rate,
+		s.MemHits, s.MemHits+s.DiskHits,
+		s.Errors, s.SlowReads, s.Corrupt, s.DigestFailures, s.Quarantined, s.Limited, s.BadSignatures,
+		float64(s.SentBytes)/1024/1024,
+		float64(s.ReceivedBytes)/1024/1024,
+		transferRate,
+	)
+}
@@ -0,0 +1,268 @@
+// Package store holds cached objects and their metadata, on local disk or
+// in an S3-compatible bucket.
+package store
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Logger is where errors that don't fail an operation are logged.
+var Logger = log.Default()
+
+// ObjectInfo describes a stored object.
+type ObjectInfo struct {
+	Name     string
+	Size     int64
+	ModTime  time.Time
+	MetaTime time.Time
+}
+
+// Storage is the backend holding cached objects and their metadata. Every
+// object is addressed by its hashed name; the metadata lives alongside it.
+type Storage interface {
+	Exists(name string) bool
+	Open(name string) (io.ReadSeekCloser, error)
+	Create(name string) (Writer, error)
+	ReadMeta(name string) ([]byte, error)
+	WriteMeta(name string, data []byte) error
+	Remove(name string) error
+	List() ([]ObjectInfo, error)
+}
+
+// Writer is a new version of an object being written. Close puts it in
+// place of the old one; Abort throws it away and leaves the old one as it
+// was.
+type Writer interface {
+	io.WriteCloser
+	Abort() error
+}
+
+// NewDisk returns a Storage keeping objects under dir, see diskStorage.
+func NewDisk(dir string, sharded bool) Storage {
+	return &diskStorage{dir: dir, sharded: sharded}
+}
+
+// diskStorage keeps objects in two levels of fan-out directories taken
+// from the start of their hashed names, e.g. ab/cd/abcd..., as a single
+// directory gets slow with 100k+ files. Objects from the flat layout used
+// before are moved into their shard when they are first accessed.
+type diskStorage struct {
+	dir     string
+	sharded bool
+}
+
+func (d *diskStorage) shardDir(name string) string {
+	if !d.sharded || len(name) < 4 {
+		return d.dir
+	}
+	return path.Join(d.dir, name[0:2], name[2:4])
+}
+
+func (d *diskStorage) dataPath(name string) string {
+	return path.Join(d.shardDir(name), name)
+}
+
+func (d *diskStorage) metaPath(name string) string {
+	return d.dataPath(name) + ".meta"
+}
+
+func (d *diskStorage) legacyPath(name string) string {
+	return path.Join(d.dir, name)
+}
+
+// migrate moves an object from the flat layout into its shard. It reports
+// whether there was anything to move.
+func (d *diskStorage) migrate(name string) bool {
+	legacy := d.legacyPath(name)
+	if !d.sharded || legacy == d.dataPath(name) {
+		return false
+	}
+	if _, err := os.Stat(legacy); err != nil {
+		return false
+	}
+
+	err := os.MkdirAll(d.shardDir(name), 0755)
+	if err == nil {
+		err = os.Rename(legacy, d.dataPath(name))
+	}
+	if err == nil {
+		err = os.Rename(legacy+".meta", d.metaPath(name))
+	}
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		Logger.Printf("error migrating %s to sharded layout: %v", name, err)
+		return false
+	}
+	return true
+}
+
+func (d *diskStorage) Exists(name string) bool {
+	_, err := os.Stat(d.metaPath(name))
+	if err != nil {
+		if !d.migrate(name) {
+			return false
+		}
+		_, err = os.Stat(d.metaPath(name))
+		if err != nil {
+			return false
+		}
+	}
+
+	_, err = os.Stat(d.dataPath(name))
+	return err == nil
+}
+
+func (d *diskStorage) Open(name string) (io.ReadSeekCloser, error) {
+	file, err := os.Open(d.dataPath(name))
+	if errors.Is(err, fs.ErrNotExist) && d.migrate(name) {
+		return os.Open(d.dataPath(name))
+	}
+	return file, err
+}
+
+// create creates a file in name's shard, making the shard if needed. It
+// is written next to filePath and only takes its place once closed, so an
+// existing file is replaced rather than overwritten; snapshots hard link
+// the files and must not see them change.
+func (d *diskStorage) create(name string, filePath string) (*replacingFile, error) {
+	file, err := os.Create(filePath + ".tmp")
+	if errors.Is(err, fs.ErrNotExist) && d.sharded {
+		err = os.MkdirAll(d.shardDir(name), 0755)
+		if err != nil {
+			return nil, err
+		}
+		file, err = os.Create(filePath + ".tmp")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &replacingFile{File: file, path: filePath}, nil
+}
+
+type replacingFile struct {
+	*os.File
+	path string
+}
+
+func (f *replacingFile) Close() error {
+	err := f.File.Close()
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), f.path)
+}
+
+func (f *replacingFile) Abort() error {
+	f.File.Close()
+	return os.Remove(f.Name())
+}
+
+func (d *diskStorage) Create(name string) (Writer, error) {
+	return d.create(name, d.dataPath(name))
+}
+
+func (d *diskStorage) ReadMeta(name string) ([]byte, error) {
+	data, err := os.ReadFile(d.metaPath(name))
+	if errors.Is(err, fs.ErrNotExist) && d.migrate(name) {
+		return os.ReadFile(d.metaPath(name))
+	}
+	return data, err
+}
+
+func (d *diskStorage) WriteMeta(name string, data []byte) error {
+	file, err := d.create(name, d.metaPath(name))
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err != nil {
+		file.Abort()
+		return err
+	}
+	return file.Close()
+}
+
+func (d *diskStorage) Remove(name string) error {
+	var errs []error
+	paths := []string{d.dataPath(name), d.metaPath(name)}
+	if d.legacyPath(name) != d.dataPath(name) {
+		paths = append(paths, d.legacyPath(name), d.legacyPath(name)+".meta")
+	}
+	for _, p := range paths {
+		err := os.Remove(p)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (d *diskStorage) List() ([]ObjectInfo, error) {
+	list, err := d.listDir(d.dir)
+	if err != nil {
+		return nil, err
+	}
+	if !d.sharded {
+		return list, nil
+	}
+
+	shards, err := filepath.Glob(path.Join(d.dir, "??", "??"))
+	if err != nil {
+		return nil, err
+	}
+	for _, shard := range shards {
+		objects, err := d.listDir(shard)
+		if err != nil {
+			Logger.Printf("error reading shard %s: %v", shard, err)
+			continue
+		}
+		list = append(list, objects...)
+	}
+
+	return list, nil
+}
+
+// listDir lists the objects directly inside dir.
+func (d *diskStorage) listDir(dirPath string) ([]ObjectInfo, error) {
+	dir, err := os.ReadDir(dirPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var list []ObjectInfo
+	for _, entry := range dir {
+		if entry.IsDir() || strings.HasSuffix(entry.Name(), ".meta") || strings.HasSuffix(entry.Name(), ".tmp") {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			Logger.Printf("error reading file info %s: %v", entry.Name(), err)
+			continue
+		}
+
+		obj := ObjectInfo{
+			Name:    entry.Name(),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		}
+
+		// Objects without metadata are reported with a zero MetaTime
+		metaInfo, err := os.Stat(path.Join(dirPath, entry.Name()+".meta"))
+		if err == nil {
+			obj.MetaTime = metaInfo.ModTime()
+		}
+
+		list = append(list, obj)
+	}
+
+	return list, nil
+}
@@ -0,0 +1,458 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+// s3Storage keeps objects in an S3-compatible bucket, so that several
+// replicas can share one cache.
+type s3Storage struct {
+	endpoint  *url.URL
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	prefix    string
+	pathStyle bool
+	client    *http.Client
+	timeout   time.Duration
+}
+
+// S3Config is where an S3 storage keeps objects and how it signs in.
+type S3Config struct {
+	Endpoint  *url.URL
+	Bucket    string
+	Region    string
+	AccessKey string
+	SecretKey string
+	Prefix    string
+	PathStyle bool
+	Client    *http.Client
+	// Timeout bounds every request but object reads and uploads, which
+	// take as long as the object does. Zero means no limit.
+	Timeout time.Duration
+}
+
+// NewS3 returns a Storage keeping objects in an S3 bucket.
+func NewS3(config S3Config) Storage {
+	return &s3Storage{
+		endpoint:  config.Endpoint,
+		bucket:    config.Bucket,
+		region:    config.Region,
+		accessKey: config.AccessKey,
+		secretKey: config.SecretKey,
+		prefix:    config.Prefix,
+		pathStyle: config.PathStyle,
+		client:    config.Client,
+		timeout:   config.Timeout,
+	}
+}
+
+// withTimeout is the context for a request that is read in full right
+// away.
+func (s *s3Storage) withTimeout() (context.Context, context.CancelFunc) {
+	if s.timeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), s.timeout)
+}
+
+func (s *s3Storage) objectUrl(key string, query url.Values) *url.URL {
+	u := *s.endpoint
+	if s.pathStyle {
+		u.Path = joinPath(u.Path, s.bucket)
+	} else {
+		u.Host = s.bucket + "." + u.Host
+	}
+	if key != "" {
+		u.Path = joinPath(u.Path, s.prefix+key)
+	} else if !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+	u.RawQuery = query.Encode()
+	return &u
+}
+
+func (s *s3Storage) do(ctx context.Context, method, key string, query url.Values, header http.Header, body io.Reader, payloadHash string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, s.objectUrl(key, query).String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if f, ok := body.(*os.File); ok {
+		info, err := f.Stat()
+		if err != nil {
+			return nil, err
+		}
+		req.ContentLength = info.Size()
+	}
+
+	s.sign(req, payloadHash, time.Now().UTC())
+	return s.client.Do(req)
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to req.
+func (s *s3Storage) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.accessKey == "" {
+		// Anonymous access to a public bucket
+		return
+	}
+
+	signedHeaders := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	canonicalHeaders := "host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+
+	query := req.URL.Query()
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var canonicalQuery []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			canonicalQuery = append(canonicalQuery, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3Escape(req.URL.Path, false),
+		strings.Join(canonicalQuery, "&"),
+		canonicalHeaders,
+		strings.Join(signedHeaders, ";"),
+		payloadHash,
+	}, "\n")
+
+	scope := day + "/" + s.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), day)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, strings.Join(signedHeaders, ";"), signature,
+	))
+}
+
+func joinPath(base, path string) string {
+	return strings.TrimSuffix(base, "/") + "/" + strings.TrimPrefix(path, "/")
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Escape encodes s the way SigV4 expects: everything but unreserved
+// characters is percent-encoded, and slashes are kept unless encodeSlash.
+func s3Escape(s string, encodeSlash bool) string {
+	var sb strings.Builder
+	for _, b := range []byte(s) {
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9',
+			b == '-', b == '_', b == '.', b == '~':
+			sb.WriteByte(b)
+		case b == '/' && !encodeSlash:
+			sb.WriteByte(b)
+		default:
+			fmt.Fprintf(&sb, "%%%02X", b)
+		}
+	}
+	return sb.String()
+}
+
+func s3Error(resp *http.Response) error {
+	if resp.StatusCode == http.StatusNotFound {
+		return fs.ErrNotExist
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("s3: %s %s: %s", resp.Request.Method, resp.Status, strings.TrimSpace(string(body)))
+}
+
+func (s *s3Storage) head(key string) (*http.Response, error) {
+	ctx, cancel := s.withTimeout()
+	defer cancel()
+	resp, err := s.do(ctx, http.MethodHead, key, nil, nil, nil, sha256Hex(nil))
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, s3Error(resp)
+	}
+	return resp, nil
+}
+
+func (s *s3Storage) get(key string) ([]byte, error) {
+	ctx, cancel := s.withTimeout()
+	defer cancel()
+	resp, err := s.do(ctx, http.MethodGet, key, nil, nil, nil, sha256Hex(nil))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, s3Error(resp)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+func (s *s3Storage) put(ctx context.Context, key string, body io.Reader, payloadHash string) error {
+	resp, err := s.do(ctx, http.MethodPut, key, nil, nil, body, payloadHash)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return s3Error(resp)
+	}
+	return nil
+}
+
+func (s *s3Storage) delete(key string) error {
+	ctx, cancel := s.withTimeout()
+	defer cancel()
+	resp, err := s.do(ctx, http.MethodDelete, key, nil, nil, nil, sha256Hex(nil))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return s3Error(resp)
+	}
+	return nil
+}
+
+func (s *s3Storage) Exists(name string) bool {
+	if _, err := s.head(name + ".meta"); err != nil {
+		return false
+	}
+	_, err := s.head(name)
+	return err == nil
+}
+
+func (s *s3Storage) Open(name string) (io.ReadSeekCloser, error) {
+	resp, err := s.head(name)
+	if err != nil {
+		return nil, err
+	}
+	return &s3Reader{s: s, key: name, size: resp.ContentLength}, nil
+}
+
+func (s *s3Storage) Create(name string) (Writer, error) {
+	// Uploads need a known length, so spool to a temporary file first
+	file, err := os.CreateTemp("", "mediacache-*")
+	if err != nil {
+		return nil, err
+	}
+	return &s3Writer{s: s, key: name, file: file}, nil
+}
+
+func (s *s3Storage) ReadMeta(name string) ([]byte, error) {
+	return s.get(name + ".meta")
+}
+
+func (s *s3Storage) WriteMeta(name string, data []byte) error {
+	ctx, cancel := s.withTimeout()
+	defer cancel()
+	return s.put(ctx, name+".meta", bytes.NewReader(data), sha256Hex(data))
+}
+
+func (s *s3Storage) Remove(name string) error {
+	errData := s.delete(name)
+	errMeta := s.delete(name + ".meta")
+	if errData != nil {
+		return errData
+	}
+	return errMeta
+}
+
+type s3ListResult struct {
+	IsTruncated           bool
+	NextContinuationToken string
+	Contents              []struct {
+		Key          string
+		LastModified time.Time
+		Size         int64
+	}
+}
+
+func (s *s3Storage) List() ([]ObjectInfo, error) {
+	objects := make(map[string]*ObjectInfo)
+	metaTimes := make(map[string]time.Time)
+
+	query := url.Values{}
+	query.Set("list-type", "2")
+	if s.prefix != "" {
+		query.Set("prefix", s.prefix)
+	}
+
+	for {
+		ctx, cancel := s.withTimeout()
+		resp, err := s.do(ctx, http.MethodGet, "", query, nil, nil, sha256Hex(nil))
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			err = s3Error(resp)
+			resp.Body.Close()
+			cancel()
+			return nil, err
+		}
+
+		var result s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, obj := range result.Contents {
+			name := strings.TrimPrefix(obj.Key, s.prefix)
+			if base, ok := strings.CutSuffix(name, ".meta"); ok {
+				metaTimes[base] = obj.LastModified
+				continue
+			}
+			objects[name] = &ObjectInfo{
+				Name:    name,
+				Size:    obj.Size,
+				ModTime: obj.LastModified,
+			}
+		}
+
+		if !result.IsTruncated {
+			break
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+
+	list := make([]ObjectInfo, 0, len(objects))
+	for name, obj := range objects {
+		obj.MetaTime = metaTimes[name]
+		list = append(list, *obj)
+	}
+	return list, nil
+}
+
+type s3Reader struct {
+	s      *s3Storage
+	key    string
+	size   int64
+	offset int64
+	body   io.ReadCloser
+}
+
+func (r *s3Reader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+
+	if r.body == nil {
+		header := http.Header{}
+		header.Set("Range", "bytes="+strconv.FormatInt(r.offset, 10)+"-")
+		resp, err := r.s.do(context.Background(), http.MethodGet, r.key, nil, header, nil, sha256Hex(nil))
+		if err != nil {
+			return 0, err
+		}
+		if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+			err = s3Error(resp)
+			resp.Body.Close()
+			return 0, err
+		}
+		r.body = resp.Body
+	}
+
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+	return n, err
+}
+
+func (r *s3Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("s3: negative seek offset")
+	}
+
+	if offset != r.offset && r.body != nil {
+		r.body.Close()
+		r.body = nil
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+func (r *s3Reader) Close() error {
+	if r.body != nil {
+		return r.body.Close()
+	}
+	return nil
+}
+
+type s3Writer struct {
+	s    *s3Storage
+	key  string
+	file *os.File
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	return w.file.Write(p)
+}
+
+func (w *s3Writer) Close() error {
+	defer os.Remove(w.file.Name())
+	defer w.file.Close()
+
+	_, err := w.file.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	return w.s.put(context.Background(), w.key, w.file, unsignedPayload)
+}
+
+func (w *s3Writer) Abort() error {
+	w.file.Close()
+	return os.Remove(w.file.Name())
+}
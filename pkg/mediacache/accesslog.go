@@ -0,0 +1,199 @@
+package mediacache
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	accessLogTarget string
+	accessLogFormat string
+
+	accessLog   io.Writer
+	accessLogMu sync.Mutex
+)
+
+func configureAccessLog() {
+	accessLogTarget = getEnv("CACHE_ACCESS_LOG", "")
+	accessLogFormat = getEnv("CACHE_ACCESS_LOG_FORMAT", "json")
+
+	switch accessLogFormat {
+	case "json", "common":
+	default:
+		invalidConfig("invalid value for CACHE_ACCESS_LOG_FORMAT: %s", accessLogFormat)
+	}
+}
+
+type accessEntryKey struct{}
+
+// accessEntry collects what we know about a request while it is handled.
+type accessEntry struct {
+	Time     time.Time `json:"-"`
+	Stamp    string    `json:"time"`
+	Remote   string    `json:"remote"`
+	Method   string    `json:"method"`
+	Path     string    `json:"path"`
+	Proto    string    `json:"proto"`
+	Result   string    `json:"result"`
+	Status   int       `json:"status"`
+	Bytes    int64     `json:"bytes"`
+	Upstream string    `json:"upstream,omitempty"`
+	Duration float64   `json:"duration_ms"`
+}
+
+// setUpstream records which upstream the response came from, if the
+// request is being logged.
+func setUpstream(r *http.Request, upstream string) {
+	if entry, ok := r.Context().Value(accessEntryKey{}).(*accessEntry); ok {
+		entry.Upstream = upstream
+	}
+}
+
+func setupAccessLog() error {
+	switch accessLogTarget {
+	case "":
+	case "stdout":
+		accessLog = os.Stdout
+	default:
+		file, err := os.OpenFile(accessLogTarget, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		accessLog = file
+	}
+	return nil
+}
+
+// reopenAccessLog opens the access log file again, for logrotate and the
+// like to move the old one out of the way first. Requests go on being
+// logged to the old file until the new one is open.
+func reopenAccessLog() error {
+	if accessLogTarget == "" || accessLogTarget == "stdout" {
+		return nil
+	}
+
+	file, err := os.OpenFile(accessLogTarget, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("error reopening access log: %w", err)
+	}
+	accessLogMu.Lock()
+	old := accessLog
+	accessLog = file
+	accessLogMu.Unlock()
+	return old.(*os.File).Close()
+}
+
+type loggingWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (lw *loggingWriter) WriteHeader(status int) {
+	if lw.status == 0 {
+		lw.status = status
+	}
+	lw.ResponseWriter.WriteHeader(status)
+}
+
+func (lw *loggingWriter) Write(p []byte) (int, error) {
+	if lw.status == 0 {
+		lw.status = http.StatusOK
+	}
+	n, err := lw.ResponseWriter.Write(p)
+	lw.bytes += int64(n)
+	return n, err
+}
+
+// ReadFrom keeps io.Copy from files on the sendfile fast path.
+func (lw *loggingWriter) ReadFrom(r io.Reader) (int64, error) {
+	if lw.status == 0 {
+		lw.status = http.StatusOK
+	}
+	n, err := io.Copy(lw.ResponseWriter, r)
+	lw.bytes += n
+	return n, err
+}
+
+func (lw *loggingWriter) Unwrap() http.ResponseWriter {
+	return lw.ResponseWriter
+}
+
+// withAccessLog logs every request handled by next.
+func withAccessLog(next http.HandlerFunc) http.HandlerFunc {
+	if accessLog == nil {
+		return next
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		entry := &accessEntry{
+			Time:   time.Now(),
+			Remote: clientIP(r),
+			Method: r.Method,
+			Path:   r.URL.RequestURI(),
+			Proto:  r.Proto,
+		}
+		lw := &loggingWriter{ResponseWriter: w}
+		next(lw, r.WithContext(context.WithValue(r.Context(), accessEntryKey{}, entry)))
+
+		entry.Status = lw.status
+		entry.Bytes = lw.bytes
+		entry.Duration = float64(time.Since(entry.Time).Microseconds()) / 1000
+		entry.Result = cacheResult(lw.Header().Get("X-Cache"), lw.status)
+		writeAccessLog(entry)
+	}
+}
+
+// cacheResult extracts HIT/MISS/etc. from our X-Cache header.
+func cacheResult(xCache string, status int) string {
+	if _, result, ok := strings.Cut(xCache, "; "); ok {
+		return result
+	}
+	if status >= 400 {
+		return "ERROR"
+	}
+	return "-"
+}
+
+func writeAccessLog(entry *accessEntry) {
+	var line []byte
+	if accessLogFormat == "json" {
+		entry.Stamp = logTime(entry.Time)
+
+		var err error
+		line, err = json.Marshal(entry)
+		if err != nil {
+			logger.Printf("error encoding access log entry: %v", err)
+			return
+		}
+		line = append(line, '\n')
+	} else {
+		upstream := entry.Upstream
+		if upstream == "" {
+			upstream = "-"
+		}
+		line = []byte(fmt.Sprintf(
+			"%s - - [%s] %q %d %d %s %s %.3f\n",
+			entry.Remote,
+			entry.Time.In(logTimezone).Format("02/Jan/2006:15:04:05 -0700"),
+			entry.Method+" "+entry.Path+" "+entry.Proto,
+			entry.Status, entry.Bytes,
+			entry.Result, upstream, entry.Duration,
+		))
+	}
+
+	accessLogMu.Lock()
+	defer accessLogMu.Unlock()
+
+	_, err := accessLog.Write(line)
+	if err != nil {
+		logger.Printf("error writing access log: %v", err)
+	}
+}
@@ -0,0 +1,63 @@
+package mediacache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAccessLogReopen(t *testing.T) {
+	target, format, log := accessLogTarget, accessLogFormat, accessLog
+	defer func() { accessLogTarget, accessLogFormat, accessLog = target, format, log }()
+
+	dir := t.TempDir()
+	accessLogTarget = filepath.Join(dir, "access.log")
+	accessLogFormat = "common"
+	err := setupAccessLog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { accessLog.(*os.File).Close() }()
+
+	handler := withAccessLog(func(w http.ResponseWriter, r *http.Request) {})
+	request := func(path string) {
+		r := httptest.NewRequest("GET", path, nil)
+		r.RemoteAddr = "192.0.2.1:1234"
+		handler(httptest.NewRecorder(), r)
+	}
+
+	request("/before.png")
+	err = os.Rename(accessLogTarget, filepath.Join(dir, "access.log.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = reopenAccessLog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	request("/after.png")
+
+	tests := []struct {
+		file string
+		path string
+	}{
+		{"access.log.1", "/before.png"},
+		{"access.log", "/after.png"},
+	}
+	for _, tt := range tests {
+		data, err := os.ReadFile(filepath.Join(dir, tt.file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+		if len(lines) != 1 || !strings.Contains(lines[0], tt.path) {
+			t.Errorf("%s = %q, want one line for %s", tt.file, lines, tt.path)
+		}
+		if !strings.HasPrefix(lines[0], "192.0.2.1 - - ") {
+			t.Errorf("%s = %q, want the client address without its port", tt.file, lines[0])
+		}
+	}
+}
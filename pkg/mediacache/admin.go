@@ -0,0 +1,323 @@
+package mediacache
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+
+	"git.hajkey.org/hajkey/mediacache/internal/cachekey"
+)
+
+const (
+	scopeReadStats    = "read-stats"
+	scopePurge        = "purge"
+	scopeConfigReload = "config-reload"
+	scopeBlocklist    = "blocklist"
+	scopePrefetch     = "prefetch"
+	scopePins         = "pins"
+	scopeAnnotate     = "annotate"
+	scopeSnapshot     = "snapshot"
+	scopeAll          = "*"
+)
+
+var adminTokensFile string
+
+func configureAdmin() {
+	adminTokensFile = getEnv("CACHE_ADMIN_TOKENS_FILE", "")
+}
+
+// adminToken is one line of the tokens file:
+//
+//	<sha256 of token, hex> <scope>[,<scope>...] [name]
+//
+// Only hashes are stored, so the file can't be used to authenticate by
+// itself. Use `mediacache hash-token <token>` to generate the hash.
+type adminToken struct {
+	hash   []byte
+	scopes map[string]bool
+	name   string
+}
+
+var (
+	adminTokens   []adminToken
+	adminTokensMu sync.RWMutex
+)
+
+func loadAdminTokens() error {
+	file, err := os.Open(adminTokensFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var tokens []adminToken
+	scanner := bufio.NewScanner(file)
+	line := 0
+	for scanner.Scan() {
+		line++
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 2 {
+			return fmt.Errorf("%s:%d: expected hash and scopes", adminTokensFile, line)
+		}
+
+		hash, err := hex.DecodeString(strings.TrimPrefix(fields[0], "sha256:"))
+		if err != nil || len(hash) != sha256.Size {
+			return fmt.Errorf("%s:%d: invalid token hash", adminTokensFile, line)
+		}
+
+		token := adminToken{
+			hash:   hash,
+			scopes: make(map[string]bool),
+			name:   fmt.Sprintf("line %d", line),
+		}
+		for _, scope := range strings.Split(fields[1], ",") {
+			switch scope {
+			case scopeReadStats, scopePurge, scopeConfigReload, scopeBlocklist, scopePrefetch, scopePins, scopeAnnotate, scopeSnapshot, scopeAll:
+				token.scopes[scope] = true
+			default:
+				return fmt.Errorf("%s:%d: unknown scope %s", adminTokensFile, line, scope)
+			}
+		}
+		if len(fields) > 2 {
+			token.name = strings.Join(fields[2:], " ")
+		}
+		tokens = append(tokens, token)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	adminTokensMu.Lock()
+	adminTokens = tokens
+	adminTokensMu.Unlock()
+
+	logger.Printf("loaded %d admin tokens", len(tokens))
+	return nil
+}
+
+// findAdminToken returns the token matching the presented secret.
+func findAdminToken(secret string) *adminToken {
+	sum := sha256.Sum256([]byte(secret))
+
+	adminTokensMu.RLock()
+	defer adminTokensMu.RUnlock()
+
+	var found *adminToken
+	for i := range adminTokens {
+		if subtle.ConstantTimeCompare(adminTokens[i].hash, sum[:]) == 1 {
+			found = &adminTokens[i]
+		}
+	}
+	return found
+}
+
+// requireScope wraps an admin handler, only letting requests through that
+// carry a token with the given scope. Every attempt is written to the log.
+func requireScope(scope string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		secret, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		token := findAdminToken(secret)
+
+		who := "anonymous"
+		if token != nil {
+			who = token.name
+		}
+
+		switch {
+		case !ok || token == nil:
+			logger.Printf("audit: %s %s %s by %s: denied (no valid token)", r.RemoteAddr, r.Method, r.URL.RequestURI(), who)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		case !token.scopes[scope] && !token.scopes[scopeAll]:
+			logger.Printf("audit: %s %s %s by %s: denied (missing scope %s)", r.RemoteAddr, r.Method, r.URL.RequestURI(), who, scope)
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+
+		logger.Printf("audit: %s %s %s by %s: allowed (%s)", r.RemoteAddr, r.Method, r.URL.RequestURI(), who, scope)
+		handler(w, withAdminName(r, who))
+	}
+}
+
+func sendJSON(w http.ResponseWriter, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(value)
+	if err != nil {
+		logger.Printf("error encoding response: %v", err)
+	}
+}
+
+func getAdminStats(w http.ResponseWriter, r *http.Request) {
+	mutex.RLock()
+	files := make(map[string]*Stats, len(locks))
+	for filename, lock := range locks {
+		files[filename] = &lock.Stats
+	}
+	mutex.RUnlock()
+
+	sendJSON(w, map[string]any{
+		"totals":     &stats,
+		"limits":     limitsReport(),
+		"routes":     routesReport(),
+		"priorities": prioritiesReport(),
+		"history":    historySince(historyParam(r)),
+		"files":      files,
+	})
+}
+
+// purgeObject removes a cached object, waiting for in-flight requests for it.
+func purgeObject(path string) error {
+	key := keyPolicy.ForPath(path)
+
+	mutex.RLock()
+	lock, ok := locks[key]
+	mutex.RUnlock()
+	if ok {
+		lock.Lock()
+		defer lock.Unlock()
+	}
+
+	err := removeObject(originalName(cachekey.Hash(key)))
+	if err != nil {
+		return err
+	}
+	return removeObject(cachekey.Hash(key))
+}
+
+func handleAdminPurge(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		getAdminPurge(w, r)
+		return
+	case http.MethodPost:
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	paths := r.URL.Query()["path"]
+	if len(paths) == 0 {
+		http.Error(w, "missing path", http.StatusBadRequest)
+		return
+	}
+
+	record := startPurge(paths)
+	purged, failed := 0, 0
+	for _, path := range paths {
+		err := purgeObject(path)
+		if err != nil {
+			logger.Printf("purge %s: error purging %s: %v", record.ID, path, err)
+			failed++
+			continue
+		}
+		purged++
+	}
+	finishPurge(record, nodeName, purged, failed)
+	logger.Printf("purge %s: %d purged, %d failed on %s", record.ID, purged, failed, nodeName)
+
+	sendJSON(w, map[string]any{"id": record.ID, "purged": purged})
+}
+
+func postAdminReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	err := reloadConfig()
+	if err != nil {
+		logger.Printf("error reloading config: %v", err)
+		http.Error(w, "error reloading config", http.StatusInternalServerError)
+		return
+	}
+
+	sendJSON(w, map[string]bool{"reloaded": true})
+}
+
+// reloadConfig rereads everything that can change at runtime, and reopens
+// the access log.
+func reloadConfig() error {
+	err := reopenAccessLog()
+	if err != nil {
+		return err
+	}
+	if adminTokensFile != "" {
+		err = loadAdminTokens()
+		if err != nil {
+			return err
+		}
+	}
+	err = loadBlocklist()
+	if err != nil {
+		return err
+	}
+	err = loadPins()
+	if err != nil {
+		return err
+	}
+	return loadLandingPage()
+}
+
+// reloadOnHangup runs reloadConfig on every SIGHUP, admin API or not, so
+// the access log can be rotated.
+func reloadOnHangup() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			logger.Print("SIGHUP received, reloading config")
+			err := reloadConfig()
+			if err != nil {
+				logger.Printf("error reloading config: %v", err)
+			}
+		}
+	}()
+}
+
+// setupAdmin registers the admin API. It is only enabled when a tokens file
+// is configured. Tokens can be rotated at runtime with SIGHUP or through the
+// API itself.
+func setupAdmin(mux *http.ServeMux) error {
+	if adminTokensFile == "" {
+		return nil
+	}
+
+	err := loadAdminTokens()
+	if err != nil {
+		return fmt.Errorf("error loading admin tokens: %w", err)
+	}
+
+	mux.HandleFunc("/admin/stats", requireScope(scopeReadStats, getAdminStats))
+	mux.HandleFunc("/admin/hosts", requireScope(scopeReadStats, getAdminHosts))
+	mux.HandleFunc("/admin/purge", requireScope(scopePurge, handleAdminPurge))
+	mux.HandleFunc("/admin/reload", requireScope(scopeConfigReload, postAdminReload))
+	mux.HandleFunc("/admin/blocklist", requireScope(scopeBlocklist, blocklist.handleAdmin(purgeBlocked)))
+	mux.HandleFunc("/admin/blocklist/export", requireScope(scopeBlocklist, blocklist.handleExport))
+	mux.HandleFunc("/admin/blocklist/import", requireScope(scopeBlocklist, blocklist.handleImport(purgeBlocked)))
+	mux.HandleFunc("/admin/pins", requireScope(scopePins, pins.handleAdmin(nil)))
+	mux.HandleFunc("/admin/pins/export", requireScope(scopePins, pins.handleExport))
+	mux.HandleFunc("/admin/pins/import", requireScope(scopePins, pins.handleImport(nil)))
+	mux.HandleFunc("/admin/annotations", requireScope(scopeAnnotate, handleAdminAnnotations))
+	mux.HandleFunc("/admin/prefetch", requireScope(scopePrefetch, postAdminPrefetch))
+	mux.HandleFunc("/admin/snapshot", requireScope(scopeSnapshot, postAdminSnapshot))
+	return nil
+}
+
+// HashToken returns the form of an admin token stored in the tokens file.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,104 @@
+package mediacache
+
+import (
+	"hash/maphash"
+	"sync"
+	"time"
+)
+
+// Most media is requested exactly once, and caching it only pushes out
+// objects that would have been hits. With CACHE_ADMISSION=second-hit an
+// object is passed through on its first miss and only cached when it is
+// requested again within CACHE_ADMISSION_WINDOW. Routes can set their own
+// policy with admission=all or admission=second-hit.
+//
+// Recent requests are remembered in a pair of Bloom filters sized for
+// CACHE_ADMISSION_KEYS keys per half window, so an occasional object is
+// admitted on its first request.
+var (
+	admission       string
+	admissionWindow time.Duration
+	admissionKeys   int64
+)
+
+func configureAdmission() {
+	admission = checkAdmission(getEnv("CACHE_ADMISSION", "all"))
+	admissionWindow = getDuration("CACHE_ADMISSION_WINDOW", "CACHE_ADMISSION_WINDOW_SECONDS", time.Second, time.Hour)
+	admissionKeys = getEnv[int64]("CACHE_ADMISSION_KEYS", 1_000_000)
+}
+
+func checkAdmission(policy string) string {
+	switch policy {
+	case "all", "second-hit":
+		return policy
+	}
+	invalidConfig("invalid value for CACHE_ADMISSION: %s", policy)
+	return ""
+}
+
+const doorkeeperHashes = 4
+
+// doorkeeper remembers which keys were seen recently. Keys are added to the
+// current filter; every half window it becomes the previous one and the
+// oldest is dropped.
+type doorkeeper struct {
+	mu       sync.Mutex
+	seed     maphash.Seed
+	current  []uint64
+	previous []uint64
+	rotated  time.Time
+}
+
+var (
+	doorkeeperOnce sync.Once
+	admissions     *doorkeeper
+)
+
+func newDoorkeeper(keys int64) *doorkeeper {
+	// 8 bits per key keeps false positives around 2%
+	words := max(keys/8, 1)
+	return &doorkeeper{
+		seed:     maphash.MakeSeed(),
+		current:  make([]uint64, words),
+		previous: make([]uint64, words),
+		rotated:  time.Now(),
+	}
+}
+
+// seen records key and reports whether it was already there.
+func (d *doorkeeper) seen(key string) bool {
+	hash := maphash.String(d.seed, key)
+	h1, h2 := hash, hash>>32|1
+	bits := uint64(len(d.current)) * 64
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if time.Since(d.rotated) > admissionWindow/2 {
+		d.previous, d.current = d.current, d.previous
+		clear(d.current)
+		d.rotated = time.Now()
+	}
+
+	inCurrent, inPrevious := true, true
+	for i := uint64(0); i < doorkeeperHashes; i++ {
+		bit := (h1 + i*h2) % bits
+		word, mask := bit/64, uint64(1)<<(bit%64)
+		inCurrent = inCurrent && d.current[word]&mask != 0
+		inPrevious = inPrevious && d.previous[word]&mask != 0
+		d.current[word] |= mask
+	}
+	return inCurrent || inPrevious
+}
+
+// admit reports whether a missing object should be cached under rt's
+// policy, counting this request towards it.
+func admit(rt *route, filename string) bool {
+	if rt.admission != "second-hit" {
+		return true
+	}
+	doorkeeperOnce.Do(func() {
+		admissions = newDoorkeeper(admissionKeys)
+	})
+	return admissions.seen(filename)
+}
@@ -0,0 +1,156 @@
+package mediacache
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"git.hajkey.org/hajkey/mediacache/internal/cachekey"
+)
+
+// Annotations attach moderation context, like notes and report IDs, to
+// cached objects. They live in the object's meta, so they survive
+// revalidation and refetches, but not purges or eviction.
+type annotation struct {
+	ID     string
+	Note   string `json:",omitempty"`
+	Report string `json:",omitempty"`
+	Author string
+	Time   time.Time
+}
+
+type adminNameKey struct{}
+
+// adminName is the name of the token r was authorized with.
+func adminName(r *http.Request) string {
+	name, _ := r.Context().Value(adminNameKey{}).(string)
+	return name
+}
+
+func withAdminName(r *http.Request, name string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), adminNameKey{}, name))
+}
+
+// annotatedObject is a search result.
+type annotatedObject struct {
+	Path        string       `json:"path"`
+	Annotations []annotation `json:"annotations"`
+}
+
+// matches reports whether the annotation mentions query, ignoring case.
+func (a annotation) matches(query string) bool {
+	query = strings.ToLower(query)
+	return strings.Contains(strings.ToLower(a.Note), query) ||
+		strings.Contains(strings.ToLower(a.Report), query)
+}
+
+// searchAnnotations finds cached objects with annotations matching query,
+// reading the meta of every indexed object. Objects whose key isn't known
+// yet are listed by their stored name.
+func searchAnnotations(query string) []annotatedObject {
+	entries, _ := index.Snapshot()
+
+	results := []annotatedObject{}
+	for name, entry := range entries {
+		meta, err := readMeta(name)
+		if err != nil || len(meta.Annotations) == 0 {
+			continue
+		}
+
+		var found []annotation
+		for _, a := range meta.Annotations {
+			if query == "" || a.matches(query) {
+				found = append(found, a)
+			}
+		}
+		if len(found) == 0 {
+			continue
+		}
+
+		path := entry.Key
+		if path == "" {
+			path = name
+		}
+		results = append(results, annotatedObject{Path: path, Annotations: found})
+	}
+	return results
+}
+
+// handleAdminAnnotations lists an object's annotations on GET, or searches
+// all of them with q instead of path. POST adds one from the note and report
+// parameters, DELETE removes the one given by id, or all of them.
+func handleAdminAnnotations(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	path := query.Get("path")
+
+	if r.Method == http.MethodGet && path == "" {
+		sendJSON(w, searchAnnotations(query.Get("q")))
+		return
+	}
+	if path == "" {
+		http.Error(w, "missing path", http.StatusBadRequest)
+		return
+	}
+
+	key := keyPolicy.ForPath(path)
+	filename := cachekey.Hash(key)
+	lock := getLock(key)
+
+	switch r.Method {
+	case http.MethodGet:
+		lock.RLock()
+		defer lock.RUnlock()
+	case http.MethodPost, http.MethodDelete:
+		lock.Lock()
+		defer lock.Unlock()
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	meta, err := readMeta(filename)
+	if err != nil {
+		http.Error(w, "not cached", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		note, report := query.Get("note"), query.Get("report")
+		if note == "" && report == "" {
+			http.Error(w, "missing note or report", http.StatusBadRequest)
+			return
+		}
+		meta.Annotations = append(meta.Annotations, annotation{
+			ID:     newID(),
+			Note:   note,
+			Report: report,
+			Author: adminName(r),
+			Time:   time.Now(),
+		})
+	case http.MethodDelete:
+		id := query.Get("id")
+		kept := meta.Annotations[:0]
+		for _, a := range meta.Annotations {
+			if id != "" && a.ID != id {
+				kept = append(kept, a)
+			}
+		}
+		meta.Annotations = kept
+	}
+
+	if r.Method != http.MethodGet {
+		err = writeMeta(filename, meta)
+		if err != nil {
+			http.Error(w, "error saving annotations", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	annotations := meta.Annotations
+	if annotations == nil {
+		annotations = []annotation{}
+	}
+	sendJSON(w, annotations)
+}
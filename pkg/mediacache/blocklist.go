@@ -0,0 +1,33 @@
+package mediacache
+
+import (
+	"strings"
+)
+
+var blocklistFile string
+
+// The blocklist holds request paths that must never be served.
+var blocklist *pathList
+
+func configureBlocklist() {
+	blocklistFile = getEnv("CACHE_BLOCKLIST_FILE", "")
+	blocklist = newPathList("blocklist", blocklistFile)
+}
+
+func loadBlocklist() error {
+	return blocklist.Load()
+}
+
+func isBlocked(filename string) bool {
+	return blocklist.Matches(filename)
+}
+
+// purgeBlocked removes newly blocked objects, which shouldn't linger in the
+// cache either.
+func purgeBlocked(paths []string) {
+	for _, path := range paths {
+		if !strings.HasSuffix(path, "*") {
+			_ = purgeObject(path)
+		}
+	}
+}
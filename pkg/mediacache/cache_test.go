@@ -0,0 +1,139 @@
+package mediacache
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"git.hajkey.org/hajkey/mediacache/internal/cachekey"
+)
+
+// getHTTP10 sends a bare HTTP/1.0 request, the way old clients do, and reads
+// the response the way they would.
+func getHTTP10(t *testing.T, addr string, target string) (*http.Response, string) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	fmt.Fprintf(conn, "GET %s HTTP/1.0\r\n\r\n", target)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(body)
+}
+
+func TestPassthroughLengthForHTTP10(t *testing.T) {
+	srv := httptest.NewServer(testCache)
+	defer srv.Close()
+
+	// Admission remembers names, so each run needs a new one
+	unique := strconv.FormatInt(time.Now().UnixNano(), 36)
+
+	tests := []struct {
+		name   string
+		target string
+		length int64
+		body   string
+	}{
+		{"not admitted", "/pass/" + unique + ".bin", int64(len("/" + unique + ".bin")), "/" + unique + ".bin"},
+		{"oversized", "/large.bin", 4096, strings.Repeat("x", 4096)},
+		{"oversized without length", "/large-chunked.bin", -1, strings.Repeat("x", 4096)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, body := getHTTP10(t, srv.Listener.Addr().String(), tt.target)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+			}
+			if !strings.HasSuffix(resp.Header.Get("X-Cache"), "; PASS") {
+				t.Errorf("X-Cache = %q, want a passthrough", resp.Header.Get("X-Cache"))
+			}
+			if len(resp.TransferEncoding) > 0 {
+				t.Errorf("Transfer-Encoding = %v for an HTTP/1.0 client", resp.TransferEncoding)
+			}
+			if resp.ContentLength != tt.length {
+				t.Errorf("Content-Length = %d, want %d", resp.ContentLength, tt.length)
+			}
+			if tt.length < 0 && !resp.Close {
+				t.Error("connection kept open without a length to end the body")
+			}
+			if body != tt.body {
+				t.Errorf("body = %.40q, want %.40q", body, tt.body)
+			}
+		})
+	}
+}
+
+// age makes a cached object look like it was retrieved long ago.
+func age(t *testing.T, key string) {
+	t.Helper()
+	filename := cachekey.Hash(key)
+	meta, err := readMeta(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta.Retrieved = time.Now().Add(-24 * time.Hour)
+	err = writeMeta(filename, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRevalidation(t *testing.T) {
+	srv := httptest.NewServer(testCache)
+	defer srv.Close()
+	defer upstreamDown.Store(false)
+
+	// Names are only fetched once, so each run needs new ones
+	unique := strconv.FormatInt(time.Now().UnixNano(), 36)
+
+	tests := []struct {
+		name      string
+		target    string
+		down      bool
+		refreshed bool
+	}{
+		{"not modified", "/etag-" + unique + ".png", false, true},
+		{"upstream failing", "/flaky-etag-" + unique + ".png", true, false},
+		{"upstream failing, no validators", "/flaky-" + unique + ".png", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstreamDown.Store(false)
+			_, body := get(t, srv, tt.target)
+
+			age(t, tt.target)
+			upstreamDown.Store(tt.down)
+			_, stale := get(t, srv, tt.target)
+			if stale != body {
+				t.Errorf("body = %q after revalidating, want %q", stale, body)
+			}
+
+			meta, err := readMeta(cachekey.Hash(tt.target))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if meta.Status != http.StatusOK {
+				t.Errorf("cached status = %d after revalidating, want %d", meta.Status, http.StatusOK)
+			}
+			if refreshed := !meta.expired(); refreshed != tt.refreshed {
+				t.Errorf("refreshed = %v, want %v", refreshed, tt.refreshed)
+			}
+		})
+	}
+}
@@ -0,0 +1,28 @@
+package mediacache
+
+import (
+	"strings"
+
+	"git.hajkey.org/hajkey/mediacache/internal/cachekey"
+)
+
+// How the query string takes part in the cache key, see cachekey.Policy.
+// CACHE_KEY_QUERY is include, ignore or allowlist, the latter keeping only
+// the parameters in CACHE_KEY_QUERY_ALLOWLIST.
+var keyPolicy cachekey.Policy
+
+func configureCacheKey() {
+	keyPolicy = cachekey.Policy{
+		Query:     checkKeyQuery(getEnv("CACHE_KEY_QUERY", "include")),
+		Allowlist: strings.Fields(strings.ReplaceAll(getEnv("CACHE_KEY_QUERY_ALLOWLIST", ""), ",", " ")),
+	}
+}
+
+func checkKeyQuery(mode string) string {
+	switch mode {
+	case "include", "ignore", "allowlist":
+		return mode
+	}
+	invalidConfig("invalid value for CACHE_KEY_QUERY: %s", mode)
+	return ""
+}
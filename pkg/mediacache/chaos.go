@@ -0,0 +1,97 @@
+package mediacache
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"time"
+
+	"git.hajkey.org/hajkey/mediacache/internal/store"
+)
+
+const (
+	ErrChaosFetch = ErrorStr("chaos: injected fetch failure")
+	ErrChaosDisk  = ErrorStr("chaos: injected disk error")
+)
+
+// Chaos mode injects faults to check that the cache copes with them:
+// upstream requests are delayed by CACHE_CHAOS_LATENCY or fail outright,
+// and object reads and writes fail, each at the given percentage of
+// attempts. Health checks go through the same path, so upstreams can be
+// made to flap too. Never enable this in production.
+var (
+	chaos                  bool
+	chaosLatency           time.Duration
+	chaosLatencyPercent    int64
+	chaosFetchErrorPercent int64
+	chaosDiskErrorPercent  int64
+)
+
+func configureChaos() {
+	chaos = getEnv("CACHE_CHAOS", false)
+	chaosLatency = getDuration("CACHE_CHAOS_LATENCY", "CACHE_CHAOS_LATENCY_MS", time.Millisecond, 0)
+	chaosLatencyPercent = getEnv[int64]("CACHE_CHAOS_LATENCY_PERCENT", 0)
+	chaosFetchErrorPercent = getEnv[int64]("CACHE_CHAOS_FETCH_ERROR_PERCENT", 0)
+	chaosDiskErrorPercent = getEnv[int64]("CACHE_CHAOS_DISK_ERROR_PERCENT", 0)
+}
+
+func chance(percent int64) bool {
+	return chaos && percent > 0 && rand.Int63n(100) < percent
+}
+
+// injectFetchFault is called before every upstream request.
+func injectFetchFault(ctx context.Context) error {
+	if chance(chaosLatencyPercent) {
+		timer := time.NewTimer(chaosLatency)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+	if chance(chaosFetchErrorPercent) {
+		return ErrChaosFetch
+	}
+	return nil
+}
+
+// chaosStorage fails object reads and writes at random.
+type chaosStorage struct {
+	store.Storage
+}
+
+func withChaos(storage store.Storage) store.Storage {
+	if !chaos {
+		return storage
+	}
+	return chaosStorage{storage}
+}
+
+func (s chaosStorage) Open(name string) (io.ReadSeekCloser, error) {
+	if chance(chaosDiskErrorPercent) {
+		return nil, ErrChaosDisk
+	}
+	return s.Storage.Open(name)
+}
+
+func (s chaosStorage) Create(name string) (store.Writer, error) {
+	if chance(chaosDiskErrorPercent) {
+		return nil, ErrChaosDisk
+	}
+	return s.Storage.Create(name)
+}
+
+func (s chaosStorage) ReadMeta(name string) ([]byte, error) {
+	if chance(chaosDiskErrorPercent) {
+		return nil, ErrChaosDisk
+	}
+	return s.Storage.ReadMeta(name)
+}
+
+func (s chaosStorage) WriteMeta(name string, data []byte) error {
+	if chance(chaosDiskErrorPercent) {
+		return ErrChaosDisk
+	}
+	return s.Storage.WriteMeta(name, data)
+}
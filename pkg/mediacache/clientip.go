@@ -0,0 +1,72 @@
+package mediacache
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Rate limits and the IP ACL go by the client's address. Behind a reverse
+// proxy that is the proxy's, unless it is listed in CACHE_TRUSTED_PROXIES
+// (IPs and CIDR ranges, like CACHE_IP_ALLOW): then the client is taken from
+// X-Forwarded-For, the last address in it that isn't a trusted proxy
+// itself, or else from X-Real-IP.
+//
+// Requests over a unix socket (CACHE_LISTEN=unix:...) have no address at
+// all. Unless "unix" is listed as a trusted proxy too, they all share one
+// rate limit bucket, and ipacl refuses every one of them.
+var (
+	trustedProxies []*net.IPNet
+	trustUnix      bool
+)
+
+func configureClientIP() {
+	var networks []string
+	for _, entry := range strings.Fields(strings.ReplaceAll(getEnv("CACHE_TRUSTED_PROXIES", ""), ",", " ")) {
+		if entry == "unix" {
+			trustUnix = true
+			continue
+		}
+		networks = append(networks, entry)
+	}
+	trustedProxies = parseNetworks("CACHE_TRUSTED_PROXIES", strings.Join(networks, " "))
+}
+
+// clientIP is the address of the client r came from, see above.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		// A unix socket
+		host = r.RemoteAddr
+		if !trustUnix {
+			return host
+		}
+	} else if !isTrustedProxy(host) {
+		return host
+	}
+
+	if forwarded := r.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+		hops := strings.Split(strings.Join(forwarded, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if net.ParseIP(hop) == nil {
+				// Whatever is further left can't be trusted either
+				break
+			}
+			host = hop
+			if !isTrustedProxy(hop) {
+				break
+			}
+		}
+		return host
+	}
+	if real := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(real) != nil {
+		return real
+	}
+	return host
+}
+
+func isTrustedProxy(host string) bool {
+	ip := net.ParseIP(host)
+	return ip != nil && containsIP(trustedProxies, ip)
+}
@@ -0,0 +1,49 @@
+package mediacache
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	overrides, proxies, unix := settingOverrides, trustedProxies, trustUnix
+	settingOverrides = map[string]string{"CACHE_TRUSTED_PROXIES": "10.0.0.0/8, unix"}
+	defer func() {
+		settingOverrides, trustedProxies, trustUnix = overrides, proxies, unix
+	}()
+	configureClientIP()
+
+	tests := []struct {
+		name      string
+		remote    string
+		forwarded string
+		realIP    string
+		want      string
+	}{
+		{"direct", "192.0.2.1:1234", "", "", "192.0.2.1"},
+		{"untrusted proxy", "192.0.2.1:1234", "198.51.100.7", "", "192.0.2.1"},
+		{"trusted proxy", "10.0.0.1:1234", "198.51.100.7", "", "198.51.100.7"},
+		{"chain of proxies", "10.0.0.1:1234", "203.0.113.9, 198.51.100.7, 10.0.0.2", "", "198.51.100.7"},
+		{"only proxies", "10.0.0.1:1234", "10.0.0.3, 10.0.0.2", "", "10.0.0.3"},
+		{"garbage", "10.0.0.1:1234", "nonsense, 198.51.100.7", "", "198.51.100.7"},
+		{"real ip", "10.0.0.1:1234", "", "198.51.100.7", "198.51.100.7"},
+		{"no headers", "10.0.0.1:1234", "", "", "10.0.0.1"},
+		{"unix socket", "@", "198.51.100.7", "", "198.51.100.7"},
+		{"ipv6", "[2001:db8::1]:1234", "198.51.100.7", "", "2001:db8::1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/a.png", nil)
+			r.RemoteAddr = tt.remote
+			if tt.forwarded != "" {
+				r.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+			if tt.realIP != "" {
+				r.Header.Set("X-Real-IP", tt.realIP)
+			}
+			if got := clientIP(r); got != tt.want {
+				t.Errorf("clientIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,189 @@
+package mediacache
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"git.hajkey.org/hajkey/mediacache/internal/store"
+)
+
+const (
+	SOFTWARE   = "MediaCache"
+	VERSION    = "v1.0+kopper1"
+	GITHUB_URL = "https://github.com/ShittyKopper/mediacache"
+)
+
+var (
+	listen      string
+	cacheDir    string
+	storageKind string
+	upstreams   []string
+	reply404    string
+	reply403    string
+	reply500    string
+	reply503    string
+	reply504    string
+
+	printStats bool
+	debugMode  bool
+
+	maxCacheFiles        int64
+	maxCacheSize         float64 // MiB, CACHE_MAX_SIZE=1GB being 1024
+	maxAge               float64
+	staleWhileRevalidate float64
+	maxStale             float64
+	negativeTTL          time.Duration
+	serverErrorTTL       time.Duration
+	cacheClean           bool
+	cleanInterval        time.Duration
+	indexFile            string
+
+	evictHighWatermark int64
+	evictLowWatermark  int64
+	evictBatch         int64
+	popularityHalfLife time.Duration
+	maintenance        *maintenanceWindow
+
+	readTimeout           time.Duration
+	lockTimeout           time.Duration
+	slowReadFallback      bool
+	upstreamHeaderTimeout time.Duration
+	upstreamIdleTimeout   time.Duration
+
+	upstreamStrategy       string
+	upstreamMaxFails       int64
+	upstreamCooldown       time.Duration
+	upstreamHealthPath     string
+	upstreamHealthInterval time.Duration
+
+	rangePassthrough    bool
+	rangeBackgroundFill bool
+	dryRun              bool
+	shutdownTimeout     time.Duration
+
+	storage store.Storage
+
+	locks = make(map[string]*lockable)
+	mutex = &sync.RWMutex{}
+)
+
+func configureCache() {
+	listen = getEnv("CACHE_LISTEN", ":3333")
+	cacheDir = getEnv("CACHE_DIR", "./cache")
+	storageKind = getEnv("CACHE_STORAGE", "disk")
+	upstreams = strings.Split(getEnv("CACHE_UPSTREAM", "https://example.com"), " ")
+	reply404 = getEnv("CACHE_REPLY_404", "")
+	reply403 = getEnv("CACHE_REPLY_403", "")
+	reply500 = getEnv("CACHE_REPLY_500", "")
+	reply503 = getEnv("CACHE_REPLY_503", "")
+	reply504 = getEnv("CACHE_REPLY_504", "")
+	printStats = getEnv("CACHE_PRINT_STATS", true)
+	debugMode = getEnv("CACHE_DEBUG", false)
+	maxCacheFiles = getEnv[int64]("CACHE_MAX_FILES", 10_000)
+	maxCacheSize = float64(getSize("CACHE_MAX_SIZE", "CACHE_MAX_SIZE_MB", 1<<20, 1000<<20)) / (1 << 20)
+	maxAge = getDuration("CACHE_MAX_AGE", "CACHE_MAX_AGE_HOURS", time.Hour, 3*time.Hour).Hours()
+	staleWhileRevalidate = getDuration("CACHE_STALE_WHILE_REVALIDATE", "CACHE_STALE_WHILE_REVALIDATE_HOURS", time.Hour, 0).Hours()
+	maxStale = getEnv[time.Duration]("CACHE_MAX_STALE", 0).Hours()
+	negativeTTL = getDuration("CACHE_NEGATIVE_TTL", "CACHE_NEGATIVE_TTL_SECONDS", time.Second, 10*time.Minute)
+	serverErrorTTL = getDuration("CACHE_5XX_TTL", "CACHE_5XX_TTL_SECONDS", time.Second, 60*time.Second)
+	cacheClean = getEnv("CACHE_CLEAN", true)
+	cleanInterval = checkCleanInterval(getEnv("CACHE_CLEAN_INTERVAL", time.Hour))
+	indexFile = getEnv("CACHE_INDEX_FILE", "")
+	evictHighWatermark = getEnv[int64]("CACHE_EVICT_HIGH_WATERMARK", 100)
+	evictLowWatermark = getEnv[int64]("CACHE_EVICT_LOW_WATERMARK", 90)
+	evictBatch = getEnv[int64]("CACHE_EVICT_BATCH", 100)
+	popularityHalfLife = getDuration("CACHE_POPULARITY_HALF_LIFE", "CACHE_POPULARITY_HALF_LIFE_HOURS", time.Hour, 24*time.Hour)
+	maintenance = parseMaintenanceWindow(getEnv("CACHE_MAINTENANCE_WINDOW", ""))
+	readTimeout = getDuration("CACHE_READ_TIMEOUT", "CACHE_READ_TIMEOUT_MS", time.Millisecond, 0)
+	lockTimeout = getDuration("CACHE_LOCK_TIMEOUT", "CACHE_LOCK_TIMEOUT_SECONDS", time.Second, 0)
+	slowReadFallback = getEnv("CACHE_SLOW_READ_FALLBACK", true)
+	upstreamHeaderTimeout = getDuration("CACHE_UPSTREAM_HEADER_TIMEOUT", "CACHE_UPSTREAM_HEADER_TIMEOUT_SECONDS", time.Second, 15*time.Second)
+	upstreamIdleTimeout = getDuration("CACHE_UPSTREAM_IDLE_TIMEOUT", "CACHE_UPSTREAM_IDLE_TIMEOUT_SECONDS", time.Second, 30*time.Second)
+	upstreamStrategy = getEnv("CACHE_UPSTREAM_STRATEGY", "ordered")
+	upstreamMaxFails = getEnv[int64]("CACHE_UPSTREAM_MAX_FAILS", 3)
+	upstreamCooldown = getDuration("CACHE_UPSTREAM_COOLDOWN", "CACHE_UPSTREAM_COOLDOWN_SECONDS", time.Second, 30*time.Second)
+	upstreamHealthPath = getEnv("CACHE_UPSTREAM_HEALTH_PATH", "")
+	upstreamHealthInterval = getDuration("CACHE_UPSTREAM_HEALTH_INTERVAL", "CACHE_UPSTREAM_HEALTH_INTERVAL_SECONDS", time.Second, 10*time.Second)
+	rangePassthrough = getEnv("CACHE_RANGE_PASSTHROUGH", false)
+	rangeBackgroundFill = getEnv("CACHE_RANGE_BACKGROUND_FILL", true)
+	dryRun = getEnv("CACHE_DRY_RUN", false)
+	shutdownTimeout = getDuration("CACHE_SHUTDOWN_TIMEOUT", "CACHE_SHUTDOWN_TIMEOUT_SECONDS", time.Second, 30*time.Second)
+}
+
+var (
+	configOnce sync.Once
+	configErr  error
+)
+
+// configure reads the settings, from config and then the environment, and
+// opens the storage. Nothing is read before, so importing the package has
+// no side effects. Only the first call counts, whether from New or one of
+// the command line helpers. Invalid settings are reported all at once.
+func configure(config Config) error {
+	configOnce.Do(func() {
+		settingOverrides = config.settings()
+		ignoreEnvironment = config.IgnoreEnvironment
+		customMiddleware = config.Middleware
+
+		configureCache()
+		configureAccessLog()
+		configureAdmin()
+		configureAdmission()
+		configureBlocklist()
+		configureCacheKey()
+		configureChaos()
+		configureClientIP()
+		configureDigests()
+		configureDisconnect()
+		configureGone()
+		configureHistory()
+		configureIngress()
+		configureIntegrity()
+		configureJournal()
+		configureJWT()
+		configureLanding()
+		configureListen()
+		configureLogTime()
+		configurePurgeLog()
+		configureLoop()
+		configureMemTier()
+		configureMetaFormat()
+		configureMiddleware()
+		configureObjectSize()
+		configurePartial()
+		configurePins()
+		configurePlaceholders()
+		configurePrefetch()
+		configurePriority()
+		configureQuarantine()
+		configureQuotas()
+		configureRateLimit()
+		configureRecompress()
+		configureSigning()
+		configureSnapshot()
+		configureStorage()
+		configureS3()
+		configureSvg()
+		configureTCP()
+
+		// These build on the settings above
+		configureUpstream()
+		configureHealth()
+		configureRoutes()
+
+		logOutput := config.LogOutput
+		if logOutput == nil {
+			logOutput = os.Stderr
+		}
+		setupLogTime(logOutput)
+
+		if len(configErrors) == 0 {
+			storage = newStorage(storageKind)
+		}
+		configErr = errors.Join(configErrors...)
+	})
+	return configErr
+}
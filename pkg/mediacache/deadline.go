@@ -0,0 +1,103 @@
+package mediacache
+
+import (
+	"io"
+	"time"
+)
+
+const (
+	ErrSlowRead = ErrorStr("cache read timed out")
+)
+
+// deadlineReader fails any single Read that takes longer than timeout, so a
+// stalled disk or network filesystem can't hang a request forever. Once a
+// read has timed out the reader is considered broken and refuses further use.
+type deadlineReader struct {
+	io.ReadSeekCloser
+
+	timeout time.Duration
+	buf     []byte
+	stalled bool
+}
+
+type readResult struct {
+	n   int
+	err error
+}
+
+func withReadDeadline(r io.ReadSeekCloser, timeout time.Duration) io.ReadSeekCloser {
+	if timeout <= 0 {
+		return r
+	}
+	return &deadlineReader{ReadSeekCloser: r, timeout: timeout}
+}
+
+func (d *deadlineReader) Read(p []byte) (int, error) {
+	if d.stalled {
+		return 0, ErrSlowRead
+	}
+
+	// The underlying read may still complete after we gave up on it, so it
+	// must never write into the caller's buffer directly
+	if len(d.buf) < len(p) {
+		d.buf = make([]byte, len(p))
+	}
+	buf := d.buf[:len(p)]
+
+	done := make(chan readResult, 1)
+	go func() {
+		n, err := d.ReadSeekCloser.Read(buf)
+		done <- readResult{n, err}
+	}()
+
+	timer := time.NewTimer(d.timeout)
+	defer timer.Stop()
+
+	select {
+	case res := <-done:
+		copy(p, buf[:res.n])
+		return res.n, res.err
+	case <-timer.C:
+		d.stalled = true
+		return 0, ErrSlowRead
+	}
+}
+
+// withDeadline runs fn, giving up with ErrSlowRead if it doesn't return
+// within timeout. A zero timeout runs fn directly. Should fn succeed after
+// all once we gave up, its result is handed to cleanup, if any, so that
+// nothing like an open file is left behind.
+func withDeadline[T any](timeout time.Duration, fn func() (T, error), cleanup func(T)) (T, error) {
+	if timeout <= 0 {
+		return fn()
+	}
+
+	type result struct {
+		value T
+		err   error
+	}
+
+	done := make(chan result, 1)
+	go func() {
+		value, err := fn()
+		done <- result{value, err}
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case res := <-done:
+		return res.value, res.err
+	case <-timer.C:
+		if cleanup != nil {
+			go func() {
+				if res := <-done; res.err == nil {
+					cleanup(res.value)
+				}
+			}()
+		}
+		var zero T
+		return zero, ErrSlowRead
+	}
+}
@@ -0,0 +1,43 @@
+package mediacache
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestWithDeadlineCleansUpLateResult(t *testing.T) {
+	release := make(chan struct{})
+	cleaned := make(chan int, 1)
+
+	_, err := withDeadline(10*time.Millisecond, func() (int, error) {
+		<-release
+		return 42, nil
+	}, func(late int) {
+		cleaned <- late
+	})
+	if !errors.Is(err, ErrSlowRead) {
+		t.Fatalf("withDeadline() error = %v, want %v", err, ErrSlowRead)
+	}
+
+	close(release)
+	select {
+	case late := <-cleaned:
+		if late != 42 {
+			t.Errorf("cleanup got %d, want 42", late)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("late result was not cleaned up")
+	}
+}
+
+func TestWithDeadlineKeepsTimelyResult(t *testing.T) {
+	value, err := withDeadline(time.Second, func() (int, error) {
+		return 42, nil
+	}, func(int) {
+		t.Error("cleanup called for a timely result")
+	})
+	if err != nil || value != 42 {
+		t.Fatalf("withDeadline() = %d, %v, want 42, nil", value, err)
+	}
+}
@@ -0,0 +1,129 @@
+package mediacache
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+var ErrDigestMismatch error = classedError{ErrIntegrity, "upstream response does not match its digest"}
+
+// Upstreams that send a digest of the body get it checked before the
+// object is admitted. Understood are Content-MD5, Digest (RFC 3230),
+// Content-Digest and Repr-Digest (RFC 9530) and S3's x-amz-checksum-*
+// headers, with whichever algorithms of them we know; the ones checked are
+// recorded in the metadata. Bodies that were decompressed on the way or
+// pieced together from ranges aren't what the digest was taken over, so
+// they go unchecked.
+var verifyDigests bool
+
+func configureDigests() {
+	verifyDigests = getEnv("CACHE_VERIFY_DIGESTS", true)
+}
+
+type expectedDigest struct {
+	algorithm string
+	sum       []byte
+	hash      hash.Hash
+}
+
+var digestAlgorithms = map[string]func() hash.Hash{
+	"md5":     md5.New,
+	"sha":     sha1.New,
+	"sha-1":   sha1.New,
+	"sha-256": sha256.New,
+	"sha-512": sha512.New,
+	"crc32":   func() hash.Hash { return crc32.NewIEEE() },
+	"crc32c":  func() hash.Hash { return crc32.New(crc32.MakeTable(crc32.Castagnoli)) },
+}
+
+// bodyDigests collects the digests an upstream sent along with a response.
+type bodyDigests []*expectedDigest
+
+func (d *bodyDigests) add(algorithm string, encoded string) {
+	algorithm = strings.ToLower(strings.TrimSpace(algorithm))
+	newHash, ok := digestAlgorithms[algorithm]
+	if !ok {
+		return
+	}
+	// RFC 9530 wraps the value in colons, as a structured field byte sequence
+	encoded = strings.Trim(strings.TrimSpace(encoded), ":")
+	sum, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		logger.Printf("ignoring invalid %s digest %q", algorithm, encoded)
+		return
+	}
+	*d = append(*d, &expectedDigest{algorithm: algorithm, sum: sum, hash: newHash()})
+}
+
+func newBodyDigests(resp *http.Response) bodyDigests {
+	if !verifyDigests || resp.Uncompressed || resp.StatusCode != http.StatusOK {
+		return nil
+	}
+
+	var digests bodyDigests
+	if value := resp.Header.Get("Content-MD5"); value != "" {
+		digests.add("md5", value)
+	}
+	for _, header := range []string{"Digest", "Content-Digest", "Repr-Digest"} {
+		for _, value := range resp.Header.Values(header) {
+			for _, item := range strings.Split(value, ",") {
+				algorithm, encoded, ok := strings.Cut(item, "=")
+				if ok {
+					digests.add(algorithm, encoded)
+				}
+			}
+		}
+	}
+	for _, algorithm := range []string{"sha256", "sha1", "crc32", "crc32c"} {
+		value := resp.Header.Get("X-Amz-Checksum-" + algorithm)
+		// Checksums of multipart uploads are over the parts, not the body
+		if value == "" || strings.Contains(value, "-") {
+			continue
+		}
+		switch algorithm {
+		case "sha256":
+			algorithm = "sha-256"
+		case "sha1":
+			algorithm = "sha-1"
+		}
+		digests.add(algorithm, value)
+	}
+	return digests
+}
+
+// writer returns a writer feeding every digest, or nil if there are none.
+func (d bodyDigests) writer() io.Writer {
+	if len(d) == 0 {
+		return nil
+	}
+	writers := make([]io.Writer, len(d))
+	for i, digest := range d {
+		writers[i] = digest.hash
+	}
+	return io.MultiWriter(writers...)
+}
+
+// check compares the body that was written against every digest, and
+// returns the algorithms that were verified.
+func (d bodyDigests) check() (verified []string, err error) {
+	for _, digest := range d {
+		if !bytes.Equal(digest.hash.Sum(nil), digest.sum) {
+			stats.DigestFailures++
+			return nil, fmt.Errorf("%w: %s", ErrDigestMismatch, digest.algorithm)
+		}
+		verified = append(verified, digest.algorithm)
+	}
+	sort.Strings(verified)
+	return verified, nil
+}
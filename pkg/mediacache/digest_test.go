@@ -0,0 +1,74 @@
+package mediacache
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestBodyDigests(t *testing.T) {
+	const body = "hello"
+	sum := func(h hash.Hash) string {
+		h.Write([]byte(body))
+		return base64.StdEncoding.EncodeToString(h.Sum(nil))
+	}
+	md5Sum, sha1Sum := sum(md5.New()), sum(sha1.New())
+	sha256Sum, sha512Sum := sum(sha256.New()), sum(sha512.New())
+	crc32Sum := sum(crc32.NewIEEE())
+	crc32cSum := sum(crc32.New(crc32.MakeTable(crc32.Castagnoli)))
+	wrong := sum(sha256.New224())
+
+	tests := []struct {
+		name         string
+		headers      []string
+		uncompressed bool
+		status       int
+		want         string
+		wantErr      error
+	}{
+		{"none", nil, false, 200, "", nil},
+		{"content-md5", []string{"Content-MD5", md5Sum}, false, 200, "md5", nil},
+		{"digest", []string{"Digest", "SHA-256=" + sha256Sum}, false, 200, "sha-256", nil},
+		{"digest list", []string{"Digest", "md5=" + md5Sum + ", SHA=" + sha1Sum}, false, 200, "md5,sha", nil},
+		{"content-digest", []string{"Content-Digest", "sha-256=:" + sha256Sum + ":"}, false, 200, "sha-256", nil},
+		{"repr-digest", []string{"Repr-Digest", "sha-512=:" + sha512Sum + ":, sha-256=:" + sha256Sum + ":"}, false, 200, "sha-256,sha-512", nil},
+		{"unknown algorithm", []string{"Digest", "unixsum=30637"}, false, 200, "", nil},
+		{"invalid encoding", []string{"Content-Digest", "sha-256=:not base64:"}, false, 200, "", nil},
+		{"amz sha256", []string{"X-Amz-Checksum-Sha256", sha256Sum}, false, 200, "sha-256", nil},
+		{"amz crc32", []string{"X-Amz-Checksum-Crc32", crc32Sum}, false, 200, "crc32", nil},
+		{"amz crc32c", []string{"X-Amz-Checksum-Crc32c", crc32cSum}, false, 200, "crc32c", nil},
+		{"amz multipart", []string{"X-Amz-Checksum-Crc32", crc32Sum + "-3"}, false, 200, "", nil},
+		{"mismatch", []string{"Content-MD5", md5Sum, "Digest", "sha-256=" + wrong}, false, 200, "", ErrDigestMismatch},
+		{"decompressed", []string{"Content-MD5", md5Sum}, true, 200, "", nil},
+		{"not a whole object", []string{"Content-MD5", md5Sum}, false, 206, "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{StatusCode: tt.status, Header: make(http.Header), Uncompressed: tt.uncompressed}
+			for i := 0; i < len(tt.headers); i += 2 {
+				resp.Header.Add(tt.headers[i], tt.headers[i+1])
+			}
+
+			digests := newBodyDigests(resp)
+			if w := digests.writer(); w != nil {
+				io.WriteString(w, body)
+			}
+			verified, err := digests.check()
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("check() error = %v, want %v", err, tt.wantErr)
+			}
+			if got := strings.Join(verified, ","); got != tt.want {
+				t.Errorf("verified = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
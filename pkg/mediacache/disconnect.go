@@ -0,0 +1,47 @@
+package mediacache
+
+import (
+	"context"
+	"net/http"
+)
+
+// What happens to a fetch when the client that started it goes away:
+//
+//   - complete: the object is still fetched and cached for the next client
+//   - abort: the fetch is cancelled, unless other clients are waiting for
+//     the same object
+//
+// Either way the fill is counted as abandoned.
+var disconnectPolicy string
+
+func configureDisconnect() {
+	disconnectPolicy = checkDisconnectPolicy(getEnv("CACHE_DISCONNECT_POLICY", "complete"))
+}
+
+func checkDisconnectPolicy(policy string) string {
+	switch policy {
+	case "complete", "abort":
+		return policy
+	}
+	invalidConfig("invalid value for CACHE_DISCONNECT_POLICY: %s", policy)
+	return ""
+}
+
+// fillContext is the context a fetch on behalf of r runs in. It keeps r's
+// values, like the Via header it came with, but not its cancellation.
+func fillContext(r *http.Request, lock *lockable) (context.Context, context.CancelFunc) {
+	if disconnectPolicy != "abort" {
+		return context.WithCancel(context.WithoutCancel(r.Context()))
+	}
+
+	ctx, cancel := context.WithCancel(context.WithoutCancel(r.Context()))
+	stop := context.AfterFunc(r.Context(), func() {
+		if lock.waiting.Load() <= 1 {
+			cancel()
+		}
+	})
+	return ctx, func() {
+		stop()
+		cancel()
+	}
+}
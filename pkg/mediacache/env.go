@@ -0,0 +1,193 @@
+package mediacache
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// byteSize is a size setting, see parseSize.
+type byteSize int64
+
+var (
+	// settingOverrides are settings given through Config, which win over
+	// the environment.
+	settingOverrides map[string]string
+	// ignoreEnvironment leaves only the overrides and defaults.
+	ignoreEnvironment bool
+
+	// configErrors collects the invalid settings found by configure.
+	configErrors []error
+)
+
+// invalidConfig records an invalid setting. The setting keeps its default,
+// but configure will fail.
+func invalidConfig(format string, args ...any) {
+	configErrors = append(configErrors, fmt.Errorf(format, args...))
+}
+
+func lookupEnv(key string) (string, bool) {
+	if value, ok := settingOverrides[key]; ok {
+		return value, true
+	}
+	if ignoreEnvironment {
+		return "", false
+	}
+	return os.LookupEnv(key)
+}
+
+func getEnv[T int64 | string | bool | time.Duration | byteSize](key string, fallback T) (result T) {
+	if value, ok := lookupEnv(key); ok {
+		var err error
+
+		switch any(result).(type) {
+		case int64:
+			var i int64
+			i, err = strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				invalidConfig("invalid value for %s: expected a whole number, got %q", key, value)
+				return fallback
+			}
+			result = any(i).(T)
+
+		case bool:
+			var b bool
+			b, err = strconv.ParseBool(value)
+			if err != nil {
+				invalidConfig("invalid value for %s: expected true or false, got %q", key, value)
+				return fallback
+			}
+			result = any(b).(T)
+
+		case time.Duration:
+			var d time.Duration
+			d, err = time.ParseDuration(strings.TrimSpace(value))
+			if err != nil {
+				invalidConfig("invalid value for %s: expected a duration like 90s, 15m or 2h, got %q", key, value)
+				return fallback
+			}
+			result = any(d).(T)
+
+		case byteSize:
+			var size int64
+			size, err = parseSize(value)
+			if err != nil {
+				invalidConfig("invalid value for %s: %v", key, err)
+				return fallback
+			}
+			result = any(byteSize(size)).(T)
+
+		case string:
+			result = any(value).(T)
+		}
+		return result
+	}
+
+	return fallback
+}
+
+// Sizes are given with a unit, like "500MB" or "1GB". Units are binary, as
+// the older _KB and _MB settings always were; KiB, MiB and so on mean the
+// same. Zero needs no unit.
+var sizeUnits = map[string]int64{
+	"B":  1,
+	"KB": 1 << 10, "KIB": 1 << 10, "K": 1 << 10,
+	"MB": 1 << 20, "MIB": 1 << 20, "M": 1 << 20,
+	"GB": 1 << 30, "GIB": 1 << 30, "G": 1 << 30,
+	"TB": 1 << 40, "TIB": 1 << 40, "T": 1 << 40,
+}
+
+func parseSize(value string) (int64, error) {
+	value = strings.TrimSpace(value)
+	if value == "0" {
+		return 0, nil
+	}
+
+	i := strings.IndexFunc(value, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if i <= 0 {
+		return 0, fmt.Errorf("expected a size with a unit, like 500MB or 1GB, got %q", value)
+	}
+	number, err := strconv.ParseFloat(value[:i], 64)
+	if err != nil {
+		return 0, fmt.Errorf("expected a size with a unit, like 500MB or 1GB, got %q", value)
+	}
+	unit, ok := sizeUnits[strings.ToUpper(strings.TrimSpace(value[i:]))]
+	if !ok {
+		return 0, fmt.Errorf("unknown unit %q, expected B, KB, MB, GB or TB", value[i:])
+	}
+	return int64(number * float64(unit)), nil
+}
+
+// formatSize is the inverse of parseSize, using the largest whole unit.
+func formatSize(size int64) string {
+	for _, unit := range []string{"TB", "GB", "MB", "KB"} {
+		if n := sizeUnits[unit]; size != 0 && size%n == 0 {
+			return strconv.FormatInt(size/n, 10) + unit
+		}
+	}
+	return strconv.FormatInt(size, 10) + "B"
+}
+
+// formatDuration is time.Duration.String without the trailing zero units,
+// so 3h rather than 3h0m0s.
+func formatDuration(d time.Duration) string {
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return s
+}
+
+// getEnvAlias reads key, falling back to legacyKey, its older spelling: a
+// plain number of legacyUnit. The old spelling still works, with a
+// deprecation warning. Setting both is refused, as there is no telling
+// which was meant.
+func getEnvAlias[T time.Duration | byteSize](key string, legacyKey string, legacyUnit T, fallback T) T {
+	_, ok := lookupEnv(key)
+	legacy, legacyOk := lookupEnv(legacyKey)
+	if _, overridden := settingOverrides[key]; overridden {
+		// A Config setting wins over the older spelling in the environment
+		legacyOk = false
+	}
+
+	switch {
+	case ok && legacyOk:
+		invalidConfig("both %s and %s are set, remove %s", key, legacyKey, legacyKey)
+		return fallback
+	case legacyOk:
+		n, err := strconv.ParseInt(legacy, 10, 64)
+		if err != nil {
+			invalidConfig("invalid value for %s: expected a whole number, got %q", legacyKey, legacy)
+			return fallback
+		}
+		value := T(n) * legacyUnit
+
+		var formatted string
+		switch v := any(value).(type) {
+		case time.Duration:
+			formatted = formatDuration(v)
+		case byteSize:
+			formatted = formatSize(int64(v))
+		}
+		logger.Printf("%s is deprecated, use %s=%s instead", legacyKey, key, formatted)
+		return value
+	}
+	return getEnv(key, fallback)
+}
+
+// getSize reads a size in bytes, see getEnvAlias.
+func getSize(key string, legacyKey string, legacyUnit int64, fallback int64) int64 {
+	return int64(getEnvAlias(key, legacyKey, byteSize(legacyUnit), byteSize(fallback)))
+}
+
+// getDuration reads a duration, see getEnvAlias.
+func getDuration(key string, legacyKey string, legacyUnit time.Duration, fallback time.Duration) time.Duration {
+	return getEnvAlias(key, legacyKey, legacyUnit, fallback)
+}
@@ -0,0 +1,122 @@
+package mediacache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    int64
+		wantErr bool
+	}{
+		{"0", 0, false},
+		{"512B", 512, false},
+		{"1KB", 1 << 10, false},
+		{"1KiB", 1 << 10, false},
+		{"4k", 4 << 10, false},
+		{"500MB", 500 << 20, false},
+		{"1.5GB", 3 << 29, false},
+		{" 2 GiB ", 2 << 30, false},
+		{"1TB", 1 << 40, false},
+		{"100", 0, true},
+		{"MB", 0, true},
+		{"1.2.3MB", 0, true},
+		{"10PB", 0, true},
+		{"-1MB", 0, true},
+		{"", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := parseSize(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseSize() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseSize() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+// withSettings runs f with only the given environment and Config
+// settings, and tells whether they were valid.
+func withSettings(t *testing.T, env map[string]string, overrides map[string]string, f func()) bool {
+	t.Helper()
+	savedOverrides, savedIgnore, savedErrors := settingOverrides, ignoreEnvironment, configErrors
+	defer func() { settingOverrides, ignoreEnvironment, configErrors = savedOverrides, savedIgnore, savedErrors }()
+
+	for key, value := range env {
+		t.Setenv(key, value)
+	}
+	settingOverrides, ignoreEnvironment, configErrors = overrides, false, nil
+	f()
+	return len(configErrors) == 0
+}
+
+func TestGetSize(t *testing.T) {
+	tests := []struct {
+		name      string
+		env       map[string]string
+		overrides map[string]string
+		want      int64
+		valid     bool
+	}{
+		{"default", nil, nil, 1 << 20, true},
+		{"new", map[string]string{"CACHE_TEST_SIZE": "2GB"}, nil, 2 << 30, true},
+		{"legacy", map[string]string{"CACHE_TEST_SIZE_MB": "3"}, nil, 3 << 20, true},
+		{"both", map[string]string{"CACHE_TEST_SIZE": "2GB", "CACHE_TEST_SIZE_MB": "3"}, nil, 1 << 20, false},
+		{"config over legacy", map[string]string{"CACHE_TEST_SIZE_MB": "3"}, map[string]string{"CACHE_TEST_SIZE": "2GB"}, 2 << 30, true},
+		{"legacy in config", nil, map[string]string{"CACHE_TEST_SIZE_MB": "3"}, 3 << 20, true},
+		{"invalid", map[string]string{"CACHE_TEST_SIZE": "2"}, nil, 1 << 20, false},
+		{"invalid legacy", map[string]string{"CACHE_TEST_SIZE_MB": "3MB"}, nil, 1 << 20, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got int64
+			valid := withSettings(t, tt.env, tt.overrides, func() {
+				got = getSize("CACHE_TEST_SIZE", "CACHE_TEST_SIZE_MB", 1<<20, 1<<20)
+			})
+			if valid != tt.valid {
+				t.Errorf("valid = %v, want %v", valid, tt.valid)
+			}
+			if got != tt.want {
+				t.Errorf("getSize() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetDuration(t *testing.T) {
+	tests := []struct {
+		name      string
+		env       map[string]string
+		overrides map[string]string
+		want      time.Duration
+		valid     bool
+	}{
+		{"default", nil, nil, time.Minute, true},
+		{"new", map[string]string{"CACHE_TEST_TIMEOUT": "90s"}, nil, 90 * time.Second, true},
+		{"new in hours", map[string]string{"CACHE_TEST_TIMEOUT": " 2h "}, nil, 2 * time.Hour, true},
+		{"legacy", map[string]string{"CACHE_TEST_TIMEOUT_SECONDS": "30"}, nil, 30 * time.Second, true},
+		{"both", map[string]string{"CACHE_TEST_TIMEOUT": "90s", "CACHE_TEST_TIMEOUT_SECONDS": "30"}, nil, time.Minute, false},
+		{"config over legacy", map[string]string{"CACHE_TEST_TIMEOUT_SECONDS": "30"}, map[string]string{"CACHE_TEST_TIMEOUT": "90s"}, 90 * time.Second, true},
+		{"no unit", map[string]string{"CACHE_TEST_TIMEOUT": "30"}, nil, time.Minute, false},
+		{"legacy with a unit", map[string]string{"CACHE_TEST_TIMEOUT_SECONDS": "30s"}, nil, time.Minute, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got time.Duration
+			valid := withSettings(t, tt.env, tt.overrides, func() {
+				got = getDuration("CACHE_TEST_TIMEOUT", "CACHE_TEST_TIMEOUT_SECONDS", time.Second, time.Minute)
+			})
+			if valid != tt.valid {
+				t.Errorf("valid = %v, want %v", valid, tt.valid)
+			}
+			if got != tt.want {
+				t.Errorf("getDuration() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
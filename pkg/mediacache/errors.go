@@ -0,0 +1,100 @@
+package mediacache
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+type ErrorStr string
+
+func (e ErrorStr) Error() string {
+	return string(e)
+}
+
+// The classes errors from fetching and serving objects fall into. Specific
+// errors belong to one of them, so errors.Is matches both, and they are
+// wrapped with whatever context the caller adds; failRequest then maps the
+// class to what the client gets.
+const (
+	ErrNotFound        = ErrorStr("object not found")
+	ErrExpired         = ErrorStr("cache expired")
+	ErrIntegrity       = ErrorStr("integrity check failed")
+	ErrUpstreamTimeout = ErrorStr("upstream timed out")
+	ErrUpstreamFailed  = ErrorStr("upstream request failed")
+
+	// Deprecated: use ErrExpired.
+	ErrCacheExpired = ErrExpired
+)
+
+// classedError is an error belonging to a class.
+type classedError struct {
+	class ErrorStr
+	msg   string
+}
+
+func (e classedError) Error() string {
+	return e.msg
+}
+
+func (e classedError) Is(target error) bool {
+	return target == e.class
+}
+
+// upstreamError puts an error from an upstream request in its class.
+func upstreamError(err error) error {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return fmt.Errorf("%w: %w", ErrUpstreamTimeout, err)
+	}
+	return fmt.Errorf("%w: %w", ErrUpstreamFailed, err)
+}
+
+// errorStatuses maps error classes, and errors that are a class of their
+// own, to the response sent for them. Anything else is an internal error.
+var errorStatuses = []struct {
+	err     error
+	status  int
+	message string
+}{
+	{ErrNotFound, http.StatusNotFound, "file not found"},
+	{ErrTooLarge, http.StatusBadGateway, "file too large"},
+	{ErrPartial, http.StatusBadGateway, "error fetching file"},
+	{ErrIntegrity, http.StatusBadGateway, "error fetching file"},
+	{ErrUpstreamTimeout, http.StatusGatewayTimeout, "error fetching file"},
+	{ErrUpstreamFailed, http.StatusBadGateway, "error fetching file"},
+	{ErrQuarantined, http.StatusBadGateway, "file quarantined"},
+	{ErrSlowRead, http.StatusGatewayTimeout, "error reading file"},
+	{ErrLockTimeout, http.StatusServiceUnavailable, "file busy, try again later"},
+}
+
+func errorStatus(err error) (status int, message string) {
+	for _, mapped := range errorStatuses {
+		if errors.Is(err, mapped.err) {
+			return mapped.status, mapped.message
+		}
+	}
+	return http.StatusInternalServerError, "error serving file"
+}
+
+// failRequest logs err, counts it towards s and the totals, and unless
+// part of the response was already sent, replies with the status it maps
+// to. Objects that don't exist count as misses, everything else as errors.
+func failRequest(w http.ResponseWriter, s *Stats, err error, n int64, doing string) {
+	status, message := errorStatus(err)
+	logger.Printf("error %s: %v", doing, err)
+	if n == 0 {
+		http.Error(w, message, status)
+	}
+
+	if status == http.StatusNotFound {
+		s.Misses++
+		stats.Misses++
+	} else {
+		s.Errors++
+		stats.Errors++
+	}
+	s.SentBytes += uint64(n)
+	stats.SentBytes += uint64(n)
+}
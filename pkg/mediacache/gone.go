@@ -0,0 +1,54 @@
+package mediacache
+
+import (
+	"net/http"
+)
+
+var ErrGone error = classedError{ErrNotFound, "upstream no longer has the object"}
+
+// When revalidation finds that the upstream now answers 404 or 410 for an
+// object it used to serve, the media has usually been deleted on purpose,
+// and keeping it around would keep serving it. CACHE_UPSTREAM_GONE decides
+// what replaces it: nothing (evict), or the upstream's answer as a negative
+// entry (negative), which spares the upstream the repeated misses. Either
+// way the cached media goes, including pinned objects and the originals of
+// recompressed ones.
+var upstreamGone string
+
+func configureGone() {
+	upstreamGone = checkUpstreamGone(getEnv("CACHE_UPSTREAM_GONE", "evict"))
+}
+
+func checkUpstreamGone(policy string) string {
+	switch policy {
+	case "evict", "negative":
+		return policy
+	}
+	invalidConfig("invalid value for CACHE_UPSTREAM_GONE: %s", policy)
+	return ""
+}
+
+// forgetGone applies CACHE_UPSTREAM_GONE after filename, which was cached
+// with status 200, has been revalidated. It returns ErrGone if the object
+// was evicted.
+func forgetGone(filename string) error {
+	meta, err := readMeta(filename)
+	if err != nil || (meta.Status != http.StatusNotFound && meta.Status != http.StatusGone) {
+		return nil
+	}
+
+	logger.Printf("upstream gone: %s now returns %d, %s", meta.Source, meta.Status, upstreamGone)
+	err = removeObject(originalName(filename))
+	if err != nil {
+		return err
+	}
+	if upstreamGone == "negative" {
+		return nil
+	}
+
+	err = removeObject(filename)
+	if err != nil {
+		return err
+	}
+	return ErrGone
+}
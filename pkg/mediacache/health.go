@@ -0,0 +1,225 @@
+package mediacache
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// upstreamState tracks the health of one upstream. Upstreams are marked
+// unhealthy after upstreamMaxFails consecutive failures, either from real
+// fetches or from active health checks, and skipped until the cooldown is
+// over.
+type upstreamState struct {
+	url string
+
+	mu             sync.Mutex
+	failures       int64
+	unhealthyUntil time.Time
+	latency        time.Duration
+
+	requests atomic.Uint64
+	errors   atomic.Uint64
+}
+
+var (
+	upstreamStates []*upstreamState
+	roundRobin     atomic.Uint64
+)
+
+func configureHealth() {
+	switch upstreamStrategy {
+	case "ordered", "round-robin", "fastest":
+	default:
+		invalidConfig("invalid value for CACHE_UPSTREAM_STRATEGY: %s", upstreamStrategy)
+	}
+	upstreamStates = newUpstreamStates(upstreams)
+}
+
+func newUpstreamStates(urls []string) []*upstreamState {
+	states := make([]*upstreamState, len(urls))
+	for i, url := range urls {
+		states[i] = &upstreamState{url: url}
+	}
+	return states
+}
+
+func (u *upstreamState) healthy() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return time.Now().After(u.unhealthyUntil)
+}
+
+func (u *upstreamState) success(latency time.Duration) {
+	u.requests.Add(1)
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.failures = 0
+	u.unhealthyUntil = time.Time{}
+	if u.latency == 0 {
+		u.latency = latency
+	} else {
+		// Exponentially weighted, so one slow request doesn't dominate
+		u.latency = (u.latency*7 + latency) / 8
+	}
+}
+
+func (u *upstreamState) failure() {
+	u.requests.Add(1)
+	u.errors.Add(1)
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.failures++
+	if u.failures >= upstreamMaxFails && time.Now().After(u.unhealthyUntil) {
+		logger.Printf("upstream %s unhealthy after %d failures", u.url, u.failures)
+		u.unhealthyUntil = time.Now().Add(upstreamCooldown)
+	}
+}
+
+// record updates the upstream's health from the outcome of a request.
+// Server errors and transport failures count against it.
+func (u *upstreamState) record(resp *http.Response, err error, started time.Time) {
+	if errors.Is(err, context.Canceled) {
+		// We gave up on it, it didn't fail
+		return
+	}
+	if err != nil || resp.StatusCode >= 500 {
+		u.failure()
+		return
+	}
+	u.success(time.Since(started))
+}
+
+// upstreamFor finds the upstream a full URL belongs to.
+func upstreamFor(url string) *upstreamState {
+	for _, u := range allUpstreams() {
+		if strings.HasPrefix(url, strings.TrimSuffix(u.url, "/")+"/") {
+			return u
+		}
+	}
+	return nil
+}
+
+// pickUpstreams returns the candidates in the order they should be tried.
+// Unhealthy upstreams are skipped, unless there is nothing else left. A
+// healthy preferred upstream, if given, is always tried first.
+func pickUpstreams(candidates []*upstreamState, preferred *upstreamState) []*upstreamState {
+	ordered := make([]*upstreamState, len(candidates))
+	copy(ordered, candidates)
+
+	switch upstreamStrategy {
+	case "round-robin":
+		if n := len(ordered); n > 0 {
+			start := int(roundRobin.Add(1) % uint64(n))
+			ordered = append(ordered[start:], ordered[:start]...)
+		}
+	case "fastest":
+		latencies := make(map[*upstreamState]time.Duration, len(ordered))
+		for _, u := range ordered {
+			u.mu.Lock()
+			latencies[u] = u.latency
+			u.mu.Unlock()
+		}
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return latencies[ordered[i]] < latencies[ordered[j]]
+		})
+	}
+
+	var healthy []*upstreamState
+	if preferred != nil && preferred.healthy() {
+		healthy = append(healthy, preferred)
+	}
+	for _, u := range ordered {
+		if u != preferred && u.healthy() {
+			healthy = append(healthy, u)
+		}
+	}
+	if len(healthy) == 0 {
+		return ordered
+	}
+	return healthy
+}
+
+// fetchUpstream requests origFilename from the route's upstreams in turn
+// until one of them answers with a status accepted by ok. If none does, the
+// last response we got is returned, so a dead upstream doesn't hide a real
+// 404 from a live one.
+func fetchUpstream(ctx context.Context, rt *route, origFilename string, header http.Header, ok func(status int) bool) (resp *http.Response, url string, err error) {
+	return fetchUpstreamFrom(ctx, rt, nil, origFilename, header, ok)
+}
+
+// fetchUpstreamFrom is fetchUpstream trying preferred first.
+func fetchUpstreamFrom(ctx context.Context, rt *route, preferred *upstreamState, origFilename string, header http.Header, ok func(status int) bool) (resp *http.Response, url string, err error) {
+	var last *http.Response
+	var lastUrl string
+
+	for _, upstream := range pickUpstreams(rt.upstreams, preferred) {
+		url = rt.url(upstream, origFilename)
+
+		var req *http.Request
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return nil, url, err
+		}
+		for key, values := range header {
+			req.Header[key] = values
+		}
+
+		started := time.Now()
+		resp, err = upstreamDo(req)
+		upstream.record(resp, err, started)
+		logger.Printf("url %s: %v", url, err)
+		if err != nil {
+			continue
+		}
+
+		if last != nil {
+			last.Body.Close()
+		}
+		if ok(resp.StatusCode) {
+			return resp, url, nil
+		}
+		last, lastUrl = resp, url
+	}
+
+	if last != nil {
+		return last, lastUrl, nil
+	}
+	return nil, url, err
+}
+
+// checkUpstreams actively probes every upstream's health check path.
+func checkUpstreams() {
+	for _, upstream := range allUpstreams() {
+		started := time.Now()
+		resp, err := upstreamGet(joinUrl(upstream.url, upstreamHealthPath))
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode >= 400 {
+				upstream.failure()
+				continue
+			}
+		}
+		upstream.record(resp, err, started)
+	}
+}
+
+func monitorUpstreams() {
+	if upstreamHealthPath == "" {
+		return
+	}
+
+	tick := time.NewTicker(upstreamHealthInterval)
+	for range tick.C {
+		checkUpstreams()
+	}
+}
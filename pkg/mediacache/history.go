@@ -0,0 +1,163 @@
+package mediacache
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The totals are sampled every minute into a ring of the last 24 hours, so
+// the stats endpoint can show hit rate trends, and what a config change
+// did to them, without an external metrics stack. With
+// CACHE_STATS_HISTORY_FILE the ring survives restarts.
+const historyMinutes = 24 * 60
+
+var statsHistoryFile string
+
+func configureHistory() {
+	statsHistoryFile = getEnv("CACHE_STATS_HISTORY_FILE", "")
+}
+
+type historyBucket struct {
+	Time          time.Time `json:"time"`
+	Requests      uint64    `json:"requests"`
+	Hits          uint64    `json:"hits"`
+	Misses        uint64    `json:"misses"`
+	Errors        uint64    `json:"errors"`
+	SentBytes     uint64    `json:"sentBytes"`
+	ReceivedBytes uint64    `json:"receivedBytes"`
+}
+
+var history struct {
+	mu      sync.Mutex
+	buckets [historyMinutes]historyBucket
+	last    historyBucket
+}
+
+// totalsBucket reads the current totals into a bucket.
+func totalsBucket() historyBucket {
+	return historyBucket{
+		Requests:      stats.Requests,
+		Hits:          stats.Hits,
+		Misses:        stats.Misses,
+		Errors:        stats.Errors,
+		SentBytes:     stats.SentBytes,
+		ReceivedBytes: stats.ReceivedBytes,
+	}
+}
+
+// recordHistory stores what happened since the last sample in the bucket
+// for the minute that just ended.
+func recordHistory(now time.Time) {
+	totals := totalsBucket()
+
+	history.mu.Lock()
+	defer history.mu.Unlock()
+
+	last := history.last
+	history.last = totals
+
+	minute := now.Truncate(time.Minute).Add(-time.Minute)
+	history.buckets[minute.Unix()/60%historyMinutes] = historyBucket{
+		Time:          minute.UTC(),
+		Requests:      totals.Requests - last.Requests,
+		Hits:          totals.Hits - last.Hits,
+		Misses:        totals.Misses - last.Misses,
+		Errors:        totals.Errors - last.Errors,
+		SentBytes:     totals.SentBytes - last.SentBytes,
+		ReceivedBytes: totals.ReceivedBytes - last.ReceivedBytes,
+	}
+}
+
+// historySince returns the buckets of the last minutes, oldest first.
+// Minutes we weren't running for are left out.
+func historySince(minutes int) []historyBucket {
+	since := time.Now().Truncate(time.Minute).Add(-time.Duration(minutes) * time.Minute)
+
+	history.mu.Lock()
+	defer history.mu.Unlock()
+
+	var buckets []historyBucket
+	for i := 1; i <= historyMinutes; i++ {
+		bucket := history.buckets[(since.Unix()/60+int64(i))%historyMinutes]
+		if !bucket.Time.IsZero() && !bucket.Time.Before(since) {
+			buckets = append(buckets, bucket)
+		}
+	}
+	return buckets
+}
+
+func loadHistory() error {
+	if statsHistoryFile == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(statsHistoryFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var buckets []historyBucket
+	err = json.Unmarshal(data, &buckets)
+	if err != nil {
+		return err
+	}
+
+	history.mu.Lock()
+	for _, bucket := range buckets {
+		history.buckets[bucket.Time.Unix()/60%historyMinutes] = bucket
+	}
+	history.mu.Unlock()
+
+	logger.Printf("loaded %d minutes of stats history", len(buckets))
+	return nil
+}
+
+func saveHistory() {
+	if statsHistoryFile == "" {
+		return
+	}
+
+	data, err := json.Marshal(historySince(historyMinutes))
+	if err != nil {
+		logger.Printf("error encoding stats history: %v", err)
+		return
+	}
+
+	tmp := statsHistoryFile + ".tmp"
+	err = os.WriteFile(tmp, data, 0644)
+	if err == nil {
+		err = os.Rename(tmp, statsHistoryFile)
+	}
+	if err != nil {
+		logger.Printf("error saving stats history %s: %v", statsHistoryFile, err)
+	}
+}
+
+// sampleHistory records a bucket at the end of every minute.
+func sampleHistory() {
+	for {
+		now := time.Now()
+		time.Sleep(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+		recordHistory(time.Now())
+		saveHistory()
+	}
+}
+
+// historyParam reads how many minutes of history the stats endpoint should
+// include, all of it by default.
+func historyParam(r *http.Request) int {
+	minutes, err := strconv.Atoi(r.URL.Query().Get("history"))
+	if err != nil || minutes <= 0 || minutes > historyMinutes {
+		return historyMinutes
+	}
+	return minutes
+}
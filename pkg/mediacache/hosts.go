@@ -0,0 +1,105 @@
+package mediacache
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+)
+
+// The index keeps a total per source host, the host of the URL an object
+// was fetched from, so questions like "how much do we hold from
+// media.example.social" don't need a scan. Objects whose source isn't known
+// yet, e.g. right after a rebuild from storage, are counted under "".
+
+type hostUsage struct {
+	Objects int64 `json:"objects"`
+	Bytes   int64 `json:"bytes"`
+	Quota   int64 `json:"quota,omitempty"`
+
+	names map[string]bool
+}
+
+func sourceHost(source string) string {
+	u, err := url.Parse(source)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
+
+// countHost and uncountHost keep the host totals in step with an entry
+// being added or removed. The index lock must be held.
+func (i *cacheIndex) countHost(name string, entry *indexEntry) {
+	usage, ok := i.hosts[entry.Host]
+	if !ok {
+		usage = &hostUsage{names: make(map[string]bool)}
+		i.hosts[entry.Host] = usage
+	}
+	usage.Objects++
+	usage.Bytes += entry.Size
+	usage.names[name] = true
+}
+
+func (i *cacheIndex) uncountHost(name string, entry *indexEntry) {
+	usage, ok := i.hosts[entry.Host]
+	if !ok {
+		return
+	}
+	usage.Objects--
+	usage.Bytes -= entry.Size
+	delete(usage.names, name)
+	if usage.Objects <= 0 {
+		delete(i.hosts, entry.Host)
+	}
+}
+
+// recountHosts rebuilds the host totals after the entries were replaced.
+// The index lock must be held.
+func (i *cacheIndex) recountHosts() {
+	i.hosts = make(map[string]*hostUsage)
+	for name, entry := range i.entries {
+		i.countHost(name, entry)
+	}
+}
+
+// Hosts returns the totals for every source host.
+func (i *cacheIndex) Hosts() map[string]hostUsage {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	hosts := make(map[string]hostUsage, len(i.hosts))
+	for host, usage := range i.hosts {
+		hosts[host] = hostUsage{Objects: usage.Objects, Bytes: usage.Bytes, Quota: quotaFor(host)}
+	}
+	return hosts
+}
+
+// HostObjects returns the names of the objects fetched from host.
+func (i *cacheIndex) HostObjects(host string) []string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	usage, ok := i.hosts[host]
+	if !ok {
+		return nil
+	}
+	names := make([]string, 0, len(usage.names))
+	for name := range usage.names {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// getAdminHosts reports the totals of every source host, or with ?host=
+// of just that one.
+func getAdminHosts(w http.ResponseWriter, r *http.Request) {
+	hosts := index.Hosts()
+	if !r.URL.Query().Has("host") {
+		sendJSON(w, hosts)
+		return
+	}
+
+	host := r.URL.Query().Get("host")
+	sendJSON(w, map[string]hostUsage{host: hosts[host]})
+}
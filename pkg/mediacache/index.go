@@ -0,0 +1,325 @@
+package mediacache
+
+import (
+	"encoding/json"
+	"math"
+	"os"
+	"sync"
+	"time"
+)
+
+// indexEntry is what eviction needs to know about a cached object, kept in
+// memory so the cache never has to be scanned to decide what to remove.
+type indexEntry struct {
+	Key        string `json:",omitempty"`
+	Host       string `json:",omitempty"`
+	Size       int64
+	Retrieved  time.Time
+	LastAccess time.Time
+
+	// Popularity is a hit count that decays exponentially, halving every
+	// popularityHalfLife, as of LastAccess.
+	Popularity float64 `json:",omitempty"`
+	// Revalidatable is set for objects with an ETag or Last-Modified date,
+	// which are revalidated once expired rather than evicted.
+	Revalidatable bool `json:",omitempty"`
+}
+
+// popularityAt returns the entry's popularity decayed to the given time.
+func (e *indexEntry) popularityAt(now time.Time) float64 {
+	if e.Popularity == 0 || popularityHalfLife <= 0 {
+		return e.Popularity
+	}
+	halfLives := float64(now.Sub(e.LastAccess)) / float64(popularityHalfLife)
+	return e.Popularity * math.Exp2(-halfLives)
+}
+
+type cacheIndex struct {
+	mu        sync.Mutex
+	entries   map[string]*indexEntry
+	totalSize int64
+	hosts     map[string]*hostUsage
+}
+
+var index = &cacheIndex{entries: make(map[string]*indexEntry), hosts: make(map[string]*hostUsage)}
+
+// Add records a freshly stored object. An empty key keeps the one already
+// known.
+func (i *cacheIndex) Add(name string, meta fileMeta) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	now := time.Now()
+	key := meta.Key
+	var popularity float64
+	if entry, ok := i.entries[name]; ok {
+		i.totalSize -= entry.Size
+		i.uncountHost(name, entry)
+		if key == "" {
+			key = entry.Key
+		}
+		popularity = entry.popularityAt(now)
+	}
+	entry := &indexEntry{
+		Key:           key,
+		Host:          sourceHost(meta.Source),
+		Size:          meta.Size,
+		Retrieved:     now,
+		LastAccess:    now,
+		Popularity:    popularity,
+		Revalidatable: meta.revalidatable(),
+	}
+	i.entries[name] = entry
+	i.totalSize += meta.Size
+	i.countHost(name, entry)
+}
+
+// Refresh marks an object as revalidated without changing its contents.
+func (i *cacheIndex) Refresh(name string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if entry, ok := i.entries[name]; ok {
+		entry.Retrieved = time.Now()
+	}
+}
+
+// Touch records a read of an object.
+func (i *cacheIndex) Touch(name string, key string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if entry, ok := i.entries[name]; ok {
+		now := time.Now()
+		entry.Key = key
+		entry.Popularity = entry.popularityAt(now) + 1
+		entry.LastAccess = now
+	}
+}
+
+func (i *cacheIndex) Remove(name string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if entry, ok := i.entries[name]; ok {
+		i.totalSize -= entry.Size
+		i.uncountHost(name, entry)
+		delete(i.entries, name)
+	}
+}
+
+// Size returns the size of all indexed objects, and of name among them.
+func (i *cacheIndex) Size(name string) (total int64, own int64) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if entry, ok := i.entries[name]; ok {
+		own = entry.Size
+	}
+	return i.totalSize, own
+}
+
+// Snapshot returns a copy of the index for eviction to work on without
+// holding the lock.
+func (i *cacheIndex) Snapshot() (entries map[string]indexEntry, totalSize int64) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	entries = make(map[string]indexEntry, len(i.entries))
+	for name, entry := range i.entries {
+		entries[name] = *entry
+	}
+	return entries, i.totalSize
+}
+
+// listEntries lists storage as index entries. Objects without metadata
+// are left out, and returned as orphans.
+func listEntries() (entries map[string]*indexEntry, orphans []string, err error) {
+	objects, err := storage.List()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	entries = make(map[string]*indexEntry, len(objects))
+	for _, obj := range objects {
+		if obj.MetaTime.IsZero() {
+			orphans = append(orphans, obj.Name)
+			continue
+		}
+
+		entries[obj.Name] = &indexEntry{
+			Size:       obj.Size,
+			Retrieved:  obj.MetaTime,
+			LastAccess: obj.MetaTime,
+		}
+	}
+	return entries, orphans, nil
+}
+
+// Rebuild replaces the index with the current contents of storage. Objects
+// without metadata are removed along the way.
+func (i *cacheIndex) Rebuild() error {
+	started := time.Now()
+	entries, orphans, err := listEntries()
+	if err != nil {
+		return err
+	}
+	for _, name := range orphans {
+		logger.Printf("error reading meta info %s: missing", name)
+		if !dryRun {
+			_ = storage.Remove(name)
+		}
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	for name, entry := range i.entries {
+		listed, ok := entries[name]
+		switch {
+		case ok:
+			// Storage doesn't know about reads, keep what we saw
+			listed.Key = entry.Key
+			listed.Host = entry.Host
+			listed.Revalidatable = entry.Revalidatable
+			if entry.LastAccess.After(listed.LastAccess) {
+				listed.LastAccess = entry.LastAccess
+				listed.Popularity = entry.Popularity
+			}
+		case entry.Retrieved.After(started):
+			// Stored while the listing was in progress
+			entries[name] = entry
+		}
+	}
+
+	i.entries = entries
+	i.totalSize = 0
+	for _, entry := range entries {
+		i.totalSize += entry.Size
+	}
+	i.recountHosts()
+	return nil
+}
+
+// Scan fills the index from storage like Rebuild, but leaves storage as it
+// is, and reads the metadata right away. It is for commands that look at
+// the cache while a server may be running on it.
+func (i *cacheIndex) Scan() error {
+	entries, _, err := listEntries()
+	if err != nil {
+		return err
+	}
+
+	i.mu.Lock()
+	i.entries = entries
+	i.totalSize = 0
+	for _, entry := range entries {
+		i.totalSize += entry.Size
+	}
+	i.recountHosts()
+	i.mu.Unlock()
+
+	i.fillFromMeta()
+	return nil
+}
+
+// fillFromMeta looks up what a listing of storage can't tell: the source
+// host, cache key and validators of objects indexed without them. Objects
+// stored before keys were kept in the metadata only get theirs once they
+// are read.
+func (i *cacheIndex) fillFromMeta() {
+	var unknown []string
+	i.mu.Lock()
+	for name, entry := range i.entries {
+		if entry.Host == "" || entry.Key == "" {
+			unknown = append(unknown, name)
+		}
+	}
+	i.mu.Unlock()
+
+	filled := 0
+	for _, name := range unknown {
+		meta, err := readMeta(name)
+		if err != nil || (meta.Source == "" && meta.Key == "") {
+			continue
+		}
+
+		i.mu.Lock()
+		if entry, ok := i.entries[name]; ok {
+			if entry.Host == "" && meta.Source != "" {
+				i.uncountHost(name, entry)
+				entry.Host = sourceHost(meta.Source)
+				i.countHost(name, entry)
+			}
+			if entry.Key == "" {
+				entry.Key = meta.Key
+			}
+			entry.Revalidatable = meta.revalidatable()
+			filled++
+		}
+		i.mu.Unlock()
+	}
+	if filled > 0 {
+		logger.Printf("found the source host and key of %d indexed objects", filled)
+	}
+}
+
+// Load reads a persisted index, falling back to scanning storage.
+func (i *cacheIndex) Load() {
+	if indexFile != "" {
+		data, err := os.ReadFile(indexFile)
+		if err == nil {
+			var entries map[string]*indexEntry
+			err = json.Unmarshal(data, &entries)
+			if err == nil {
+				i.mu.Lock()
+				i.entries = entries
+				i.totalSize = 0
+				for _, entry := range entries {
+					i.totalSize += entry.Size
+				}
+				i.recountHosts()
+				i.mu.Unlock()
+				logger.Printf("loaded index of %d objects from %s", len(entries), indexFile)
+				return
+			}
+		}
+		logger.Printf("error loading index %s: %v", indexFile, err)
+	}
+
+	err := i.Rebuild()
+	if err != nil {
+		logger.Printf("error listing cache: %v", err)
+	}
+}
+
+// Save persists the index if CACHE_INDEX_FILE is set.
+func (i *cacheIndex) Save() {
+	if indexFile == "" {
+		return
+	}
+
+	i.mu.Lock()
+	data, err := json.Marshal(i.entries)
+	i.mu.Unlock()
+	if err != nil {
+		logger.Printf("error encoding index: %v", err)
+		return
+	}
+
+	tmp := indexFile + ".tmp"
+	err = os.WriteFile(tmp, data, 0644)
+	if err == nil {
+		err = os.Rename(tmp, indexFile)
+	}
+	if err != nil {
+		logger.Printf("error saving index %s: %v", indexFile, err)
+	}
+}
+
+// removeObject deletes an object from storage and the index.
+func removeObject(name string) error {
+	memTier.Remove(name)
+	index.Remove(name)
+	return storage.Remove(name)
+}
@@ -0,0 +1,65 @@
+package mediacache
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// CACHE_MAX_INGRESS_PER_SECOND caps how fast we pull from the upstreams
+// overall. Concurrency limits alone let a few huge downloads saturate the
+// link; with a cap, new fills queue while the measured rate is above it.
+// Fills that are already running are never slowed down.
+var maxIngress int64
+
+func configureIngress() {
+	maxIngress = getSize("CACHE_MAX_INGRESS_PER_SECOND", "CACHE_MAX_INGRESS_MB_PER_SECOND", 1<<20, 0)
+}
+
+var ingressStats struct {
+	rate        atomic.Int64
+	waiting     atomic.Int64
+	queued      atomic.Uint64
+	queuedNanos atomic.Int64
+}
+
+// measureIngress samples the upstream receive rate once a second.
+func measureIngress() {
+	if maxIngress <= 0 {
+		return
+	}
+
+	last := upstreamStats.received.Load()
+	tick := time.NewTicker(time.Second)
+	for range tick.C {
+		received := upstreamStats.received.Load()
+		ingressStats.rate.Store(int64(received - last))
+		last = received
+	}
+}
+
+// waitIngress holds a fill back while we are receiving faster than the cap.
+func waitIngress(ctx context.Context) error {
+	if maxIngress <= 0 || ingressStats.rate.Load() < maxIngress {
+		return nil
+	}
+
+	started := time.Now()
+	ingressStats.queued.Add(1)
+	ingressStats.waiting.Add(1)
+	defer func() {
+		ingressStats.waiting.Add(-1)
+		ingressStats.queuedNanos.Add(int64(time.Since(started)))
+	}()
+
+	tick := time.NewTicker(100 * time.Millisecond)
+	defer tick.Stop()
+	for ingressStats.rate.Load() >= maxIngress {
+		select {
+		case <-tick.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
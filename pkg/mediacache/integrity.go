@@ -0,0 +1,88 @@
+package mediacache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"time"
+)
+
+var (
+	ErrCorrupt   error = classedError{ErrIntegrity, "cached object does not match its metadata"}
+	ErrTruncated error = classedError{ErrIntegrity, "upstream response shorter than its Content-Length"}
+)
+
+var scrubInterval time.Duration
+
+func configureIntegrity() {
+	scrubInterval = getDuration("CACHE_SCRUB_INTERVAL", "CACHE_SCRUB_INTERVAL_HOURS", time.Hour, 0)
+}
+
+// checkSize makes sure an opened object is as large as its metadata says,
+// so a truncated file is never served with a Content-Length it can't fill.
+// The file is left positioned at the start.
+func checkSize(file io.ReadSeeker, meta *fileMeta) error {
+	size, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if size != meta.Size {
+		return fmt.Errorf("%w: size %d, expected %d", ErrCorrupt, size, meta.Size)
+	}
+	_, err = file.Seek(0, io.SeekStart)
+	return err
+}
+
+// verifyObject reads an object in full and compares it with the size and
+// checksum recorded when it was fetched. Objects stored before checksums
+// were recorded only get their size checked.
+func verifyObject(name string) error {
+	meta, err := readMeta(name)
+	if err != nil {
+		return err
+	}
+
+	file, err := storage.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	sha := sha256.New()
+	size, err := io.Copy(sha, file)
+	if err != nil {
+		return err
+	}
+	if size != meta.Size {
+		return fmt.Errorf("%w: size %d, expected %d", ErrCorrupt, size, meta.Size)
+	}
+	if sum := hex.EncodeToString(sha.Sum(nil)); meta.Checksum != "" && sum != meta.Checksum {
+		return fmt.Errorf("%w: checksum %s, expected %s", ErrCorrupt, sum, meta.Checksum)
+	}
+	return nil
+}
+
+// scrubCache verifies every indexed object and removes the ones that have
+// been damaged since they were written. They are fetched again on the next
+// request for them.
+func scrubCache() {
+	started := time.Now()
+	entries, _ := index.Snapshot()
+
+	var corrupt int
+	for name, entry := range entries {
+		err := verifyObject(name)
+		if err == nil {
+			continue
+		}
+
+		logger.Printf("scrub: %s (%s): %v", name, entry.Key, err)
+		if evictObject(name, entry.Key) {
+			corrupt++
+			stats.Corrupt++
+		}
+	}
+
+	logger.Printf("scrub: checked %d objects in %s, %s %d", len(entries), time.Since(started).Round(time.Millisecond), evictVerb(), corrupt)
+}
@@ -0,0 +1,127 @@
+package mediacache
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"strings"
+	"sync"
+)
+
+// The miss journal is an append-only file of the paths that missed, so
+// after a crash or restart the most recent CACHE_MISS_JOURNAL_REPLAY of them
+// can be prefetched again, before organic traffic gets around to it. It is
+// compacted down to those when the node starts, and whenever it grows to
+// several times that.
+var (
+	missJournalFile   string
+	missJournalReplay int64
+)
+
+func configureJournal() {
+	missJournalFile = getEnv("CACHE_MISS_JOURNAL", "")
+	missJournalReplay = getEnv[int64]("CACHE_MISS_JOURNAL_REPLAY", 1000)
+}
+
+var missJournal struct {
+	mu       sync.Mutex
+	file     *os.File
+	recent   []string
+	appended int64
+
+	// replay holds the paths to prefetch at startup, most recent first.
+	replay []string
+}
+
+// loadMissJournal reads and compacts the journal and opens it for appending.
+func loadMissJournal() error {
+	if missJournalFile == "" {
+		return nil
+	}
+
+	file, err := os.Open(missJournalFile)
+	var paths []string
+	if err == nil {
+		paths, err = readPaths(file)
+		file.Close()
+	} else if errors.Is(err, fs.ErrNotExist) {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// Most recent first, each path once
+	seen := make(map[string]bool)
+	for i := len(paths) - 1; i >= 0 && int64(len(missJournal.replay)) < missJournalReplay; i-- {
+		if !seen[paths[i]] {
+			seen[paths[i]] = true
+			missJournal.replay = append(missJournal.replay, paths[i])
+		}
+	}
+	for i := len(missJournal.replay) - 1; i >= 0; i-- {
+		missJournal.recent = append(missJournal.recent, missJournal.replay[i])
+	}
+
+	missJournal.mu.Lock()
+	defer missJournal.mu.Unlock()
+	return compactMissJournal()
+}
+
+// compactMissJournal rewrites the journal with only the recent paths.
+// missJournal.mu must be held.
+func compactMissJournal() error {
+	var sb strings.Builder
+	for _, path := range missJournal.recent {
+		sb.WriteString(path)
+		sb.WriteByte('\n')
+	}
+
+	tmp := missJournalFile + ".tmp"
+	err := os.WriteFile(tmp, []byte(sb.String()), 0644)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp, missJournalFile)
+	if err != nil {
+		return err
+	}
+
+	if missJournal.file != nil {
+		missJournal.file.Close()
+	}
+	missJournal.file, err = os.OpenFile(missJournalFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	missJournal.appended = 0
+	return err
+}
+
+// journalMiss records that path missed.
+func journalMiss(path string) {
+	if missJournalFile == "" {
+		return
+	}
+
+	missJournal.mu.Lock()
+	defer missJournal.mu.Unlock()
+
+	if missJournal.file == nil {
+		return
+	}
+	_, err := missJournal.file.WriteString(path + "\n")
+	if err != nil {
+		logger.Printf("error writing miss journal: %v", err)
+		return
+	}
+
+	missJournal.recent = append(missJournal.recent, path)
+	if over := int64(len(missJournal.recent)) - missJournalReplay; over > 0 {
+		missJournal.recent = missJournal.recent[over:]
+	}
+	missJournal.appended++
+	if missJournal.appended > 4*max(missJournalReplay, 1) {
+		err = compactMissJournal()
+		if err != nil {
+			logger.Printf("error compacting miss journal: %v", err)
+		}
+	}
+}
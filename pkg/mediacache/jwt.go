@@ -0,0 +1,300 @@
+package mediacache
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+)
+
+// With CACHE_JWT_KEY or CACHE_JWT_PUBLIC_KEY set, the jwt middleware only
+// lets requests with a valid JSON Web Token through. Clients send it as
+// "Authorization: Bearer <token>", or, where they can't set headers, in the
+// CACHE_JWT_PARAM query parameter (token by default), which is neither part
+// of the cache key nor sent upstream.
+//
+// CACHE_JWT_KEY is the secret for HS256, HS384 and HS512 tokens.
+// CACHE_JWT_PUBLIC_KEY is a PEM file with an RSA, ECDSA or Ed25519 public
+// key, for RS*, PS*, ES* and EdDSA tokens. Tokens have to expire, so exp is
+// required; nbf is checked if present. CACHE_JWT_ISSUER and
+// CACHE_JWT_AUDIENCE, if set, have to match iss and aud. Rejected tokens
+// count as bad signatures.
+var (
+	jwtKey           string
+	jwtPublicKeyFile string
+	jwtPublicKey     crypto.PublicKey
+	jwtParam         string
+	jwtIssuer        string
+	jwtAudience      string
+)
+
+func configureJWT() {
+	jwtKey = getEnv("CACHE_JWT_KEY", "")
+	jwtPublicKeyFile = getEnv("CACHE_JWT_PUBLIC_KEY", "")
+	jwtParam = getEnv("CACHE_JWT_PARAM", "token")
+	jwtIssuer = getEnv("CACHE_JWT_ISSUER", "")
+	jwtAudience = getEnv("CACHE_JWT_AUDIENCE", "")
+
+	jwtPublicKey = nil
+	if jwtPublicKeyFile != "" {
+		var err error
+		jwtPublicKey, err = loadPublicKey(jwtPublicKeyFile)
+		if err != nil {
+			invalidConfig("invalid value for CACHE_JWT_PUBLIC_KEY: %v", err)
+		}
+	}
+}
+
+func jwtConfigured() bool {
+	return jwtKey != "" || jwtPublicKeyFile != ""
+}
+
+// loadPublicKey reads a PEM encoded public key, in PKIX or, for RSA, PKCS #1
+// form.
+func loadPublicKey(file string) (crypto.PublicKey, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", file)
+	}
+	if block.Type == "RSA PUBLIC KEY" {
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	switch key.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey, ed25519.PublicKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("%s: unsupported key type %T", file, key)
+	}
+}
+
+// withJWT is the jwt middleware. It refuses requests without a valid token,
+// and takes the token parameter out of the query for the handlers after
+// it. The landing page needs no token.
+func withJWT(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !jwtConfigured() || r.URL.Path == "/" {
+			next(w, r)
+			return
+		}
+
+		token, r := takeToken(r)
+		err := checkJWT(token, time.Now())
+		if err != nil {
+			logger.Printf("refusing request for `%s`, %v", r.URL.RequestURI(), err)
+			stats.BadSignatures++
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// takeToken finds the token in r, and returns r without the token
+// parameter. The rest of the query is kept as it was sent.
+func takeToken(r *http.Request) (string, *http.Request) {
+	var token string
+	scheme, credentials, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	if strings.EqualFold(scheme, "Bearer") {
+		token = strings.TrimSpace(credentials)
+	}
+	if jwtParam == "" || r.URL.RawQuery == "" {
+		return token, r
+	}
+
+	var kept []string
+	found := false
+	for _, param := range strings.Split(r.URL.RawQuery, "&") {
+		key, value, _ := strings.Cut(param, "=")
+		if key != jwtParam {
+			kept = append(kept, param)
+			continue
+		}
+		found = true
+		if token == "" {
+			token, _ = url.QueryUnescape(value)
+		}
+	}
+	if !found {
+		return token, r
+	}
+
+	r = r.Clone(r.Context())
+	r.URL.RawQuery = strings.Join(kept, "&")
+	return token, r
+}
+
+type jwtClaims struct {
+	Issuer    string   `json:"iss"`
+	Audience  audience `json:"aud"`
+	ExpiresAt *float64 `json:"exp"`
+	NotBefore *float64 `json:"nbf"`
+}
+
+// audience is the aud claim, which may be a string or a list of them.
+type audience []string
+
+func (aud *audience) UnmarshalJSON(data []byte) error {
+	var one string
+	if json.Unmarshal(data, &one) == nil {
+		*aud = audience{one}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(aud))
+}
+
+// checkJWT verifies token's signature and claims at now.
+func checkJWT(token string, now time.Time) error {
+	if token == "" {
+		return errors.New("no token")
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return errors.New("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	err := decodeSegment(parts[0], &header)
+	if err != nil {
+		return err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return errors.New("malformed token signature")
+	}
+	err = verifyJWT(header.Alg, parts[0]+"."+parts[1], signature)
+	if err != nil {
+		return err
+	}
+
+	var claims jwtClaims
+	err = decodeSegment(parts[1], &claims)
+	if err != nil {
+		return err
+	}
+	unix := float64(now.Unix())
+	switch {
+	case claims.ExpiresAt == nil:
+		return errors.New("token never expires")
+	case *claims.ExpiresAt <= unix:
+		return errors.New("token expired")
+	case claims.NotBefore != nil && *claims.NotBefore > unix:
+		return errors.New("token not valid yet")
+	case jwtIssuer != "" && claims.Issuer != jwtIssuer:
+		return fmt.Errorf("token issued by %q", claims.Issuer)
+	}
+	if jwtAudience == "" {
+		return nil
+	}
+	for _, aud := range claims.Audience {
+		if aud == jwtAudience {
+			return nil
+		}
+	}
+	return fmt.Errorf("token for %q", []string(claims.Audience))
+}
+
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err == nil {
+		err = json.Unmarshal(data, v)
+	}
+	if err != nil {
+		return fmt.Errorf("malformed token: %v", err)
+	}
+	return nil
+}
+
+// verifyJWT checks signature against the key for alg. Tokens can't pick a
+// key type other than the one configured for their algorithm, so an HMAC
+// token can't be signed with the public key.
+func verifyJWT(alg string, signed string, signature []byte) error {
+	var hash crypto.Hash
+	switch alg[min(2, len(alg)):] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	}
+	if alg == "EdDSA" {
+		hash = crypto.SHA512
+	}
+	if hash == 0 {
+		return fmt.Errorf("unsupported token algorithm %q", alg)
+	}
+
+	digest := hash.New()
+	digest.Write([]byte(signed))
+	sum := digest.Sum(nil)
+
+	ok := false
+	switch key := jwtPublicKey.(type) {
+	case *rsa.PublicKey:
+		switch alg[:2] {
+		case "RS":
+			ok = rsa.VerifyPKCS1v15(key, hash, sum, signature) == nil
+		case "PS":
+			ok = rsa.VerifyPSS(key, hash, sum, signature, nil) == nil
+		}
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if alg[:2] == "ES" && len(signature) == 2*size && key.Curve.Params().BitSize == ecdsaBits(hash) {
+			r := new(big.Int).SetBytes(signature[:size])
+			s := new(big.Int).SetBytes(signature[size:])
+			ok = ecdsa.Verify(key, sum, r, s)
+		}
+	case ed25519.PublicKey:
+		ok = alg == "EdDSA" && ed25519.Verify(key, []byte(signed), signature)
+	}
+	if alg[:2] == "HS" && jwtKey != "" {
+		mac := hmac.New(hash.New, []byte(jwtKey))
+		mac.Write([]byte(signed))
+		ok = hmac.Equal(signature, mac.Sum(nil))
+	}
+
+	if !ok {
+		return fmt.Errorf("invalid %s token signature", alg)
+	}
+	return nil
+}
+
+// ecdsaBits is the curve ES256, ES384 and ES512 go with.
+func ecdsaBits(hash crypto.Hash) int {
+	switch hash {
+	case crypto.SHA256:
+		return 256
+	case crypto.SHA384:
+		return 384
+	default:
+		return 521
+	}
+}
@@ -0,0 +1,169 @@
+package mediacache
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// token makes a JWT with claims, signed by sign.
+func token(alg string, claims map[string]any, sign func(signed []byte) []byte) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sign([]byte(signed)))
+}
+
+func hs256(key string) func([]byte) []byte {
+	return func(signed []byte) []byte {
+		mac := hmac.New(sha256.New, []byte(key))
+		mac.Write(signed)
+		return mac.Sum(nil)
+	}
+}
+
+func TestCheckJWT(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPublic, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rs256 := func(signed []byte) []byte {
+		sum := sha256.Sum256(signed)
+		signature, _ := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, sum[:])
+		return signature
+	}
+	es256 := func(signed []byte) []byte {
+		sum := sha256.Sum256(signed)
+		r, s, _ := ecdsa.Sign(rand.Reader, ecKey, sum[:])
+		return append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	eddsa := func(signed []byte) []byte { return ed25519.Sign(edKey, signed) }
+
+	now := time.Now()
+	valid := map[string]any{"exp": now.Add(time.Hour).Unix(), "iss": "app", "aud": []string{"media", "other"}}
+	claims := func(changes map[string]any) map[string]any {
+		merged := map[string]any{}
+		for k, v := range valid {
+			merged[k] = v
+		}
+		for k, v := range changes {
+			if v == nil {
+				delete(merged, k)
+			} else {
+				merged[k] = v
+			}
+		}
+		return merged
+	}
+
+	tests := []struct {
+		name   string
+		key    crypto.PublicKey
+		token  string
+		wantOK bool
+	}{
+		{"hs256", nil, token("HS256", valid, hs256("secret")), true},
+		{"hs256 wrong key", nil, token("HS256", valid, hs256("other")), false},
+		{"rs256", &rsaKey.PublicKey, token("RS256", valid, rs256), true},
+		{"es256", &ecKey.PublicKey, token("ES256", valid, es256), true},
+		{"es256 as es384", &ecKey.PublicKey, token("ES384", valid, es256), false},
+		{"eddsa", edPublic, token("EdDSA", valid, eddsa), true},
+		{"eddsa with another key", &ecKey.PublicKey, token("EdDSA", valid, eddsa), false},
+		{"hs256 signed with the public key", &rsaKey.PublicKey, token("HS256", valid, hs256("")), false},
+		{"none", nil, token("none", valid, func([]byte) []byte { return nil }), false},
+		{"expired", nil, token("HS256", claims(map[string]any{"exp": now.Add(-time.Minute).Unix()}), hs256("secret")), false},
+		{"no expiry", nil, token("HS256", claims(map[string]any{"exp": nil}), hs256("secret")), false},
+		{"not valid yet", nil, token("HS256", claims(map[string]any{"nbf": now.Add(time.Hour).Unix()}), hs256("secret")), false},
+		{"valid since", nil, token("HS256", claims(map[string]any{"nbf": now.Add(-time.Hour).Unix()}), hs256("secret")), true},
+		{"wrong issuer", nil, token("HS256", claims(map[string]any{"iss": "someone"}), hs256("secret")), false},
+		{"audience as a string", nil, token("HS256", claims(map[string]any{"aud": "media"}), hs256("secret")), true},
+		{"wrong audience", nil, token("HS256", claims(map[string]any{"aud": "other"}), hs256("secret")), false},
+		{"malformed", nil, "not.a.token", false},
+		{"empty", nil, "", false},
+	}
+
+	savedKey, savedPublic, savedIssuer, savedAudience := jwtKey, jwtPublicKey, jwtIssuer, jwtAudience
+	defer func() {
+		jwtKey, jwtPublicKey, jwtIssuer, jwtAudience = savedKey, savedPublic, savedIssuer, savedAudience
+	}()
+	jwtIssuer, jwtAudience = "app", "media"
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jwtKey, jwtPublicKey = "", tt.key
+			if tt.key == nil {
+				jwtKey = "secret"
+			}
+			err := checkJWT(tt.token, now)
+			if ok := err == nil; ok != tt.wantOK {
+				t.Errorf("checkJWT() error = %v, want ok = %v", err, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestJWTMiddleware(t *testing.T) {
+	savedKey, savedParam := jwtKey, jwtParam
+	defer func() { jwtKey, jwtParam = savedKey, savedParam }()
+	jwtKey, jwtParam = "secret", "token"
+
+	exp := map[string]any{"exp": time.Now().Add(time.Hour).Unix()}
+	valid := token("HS256", exp, hs256("secret"))
+	invalid := token("HS256", exp, hs256("other"))
+
+	tests := []struct {
+		name   string
+		target string
+		header string
+		status int
+		query  string
+	}{
+		{"header", "/a.png?w=400", "Bearer " + valid, http.StatusOK, "w=400"},
+		{"query", "/a.png?w=400&token=" + valid + "&h=300", "", http.StatusOK, "w=400&h=300"},
+		{"query, header wins", "/a.png?token=" + invalid, "bearer " + valid, http.StatusOK, ""},
+		{"invalid", "/a.png", "Bearer " + invalid, http.StatusUnauthorized, ""},
+		{"missing", "/a.png?w=400", "", http.StatusUnauthorized, ""},
+		{"landing page", "/", "", http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var query string
+			handler := withJWT(func(w http.ResponseWriter, r *http.Request) {
+				query = r.URL.RawQuery
+			})
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", tt.target, nil)
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+			handler(w, r)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d", w.Code, tt.status)
+			}
+			if tt.status == http.StatusOK && query != tt.query {
+				t.Errorf("query = %q, want %q", query, tt.query)
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package mediacache
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	texttemplate "text/template"
+)
+
+// The root page says what software this is, unless CACHE_LANDING_PAGE
+// points to a page of the operator's own. It is a Go template, HTML if the
+// file name ends in .html, with these fields:
+//
+//	{{.Name}} {{.Contact}}              CACHE_INSTANCE_NAME, CACHE_CONTACT
+//	{{.Software}} {{.Version}} {{.URL}} what is running
+//	{{.Node}}                           CACHE_NODE_NAME
+//
+// It is read again on config reloads. Tools should use /version instead,
+// which is always the same JSON.
+var (
+	landingPageFile string
+	instanceName    string
+	contact         string
+)
+
+func configureLanding() {
+	landingPageFile = getEnv("CACHE_LANDING_PAGE", "")
+	instanceName = getEnv("CACHE_INSTANCE_NAME", "")
+	contact = getEnv("CACHE_CONTACT", "")
+}
+
+type landingData struct {
+	Name     string
+	Contact  string
+	Software string
+	Version  string
+	URL      string
+	Node     string
+}
+
+type landingTemplate interface {
+	Execute(w io.Writer, data any) error
+}
+
+var (
+	landingPage        landingTemplate
+	landingContentType string
+	landingMu          sync.RWMutex
+)
+
+func loadLandingPage() error {
+	if landingPageFile == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(landingPageFile)
+	if err != nil {
+		return err
+	}
+
+	var page landingTemplate
+	ext := filepath.Ext(landingPageFile)
+	if ext == ".html" || ext == ".htm" {
+		page, err = htmltemplate.New("landing").Parse(string(data))
+	} else {
+		page, err = texttemplate.New("landing").Parse(string(data))
+	}
+	if err != nil {
+		return err
+	}
+
+	contentType := mime.TypeByExtension(ext)
+	if contentType == "" {
+		contentType = "text/plain; charset=utf-8"
+	}
+
+	landingMu.Lock()
+	landingPage, landingContentType = page, contentType
+	landingMu.Unlock()
+
+	logger.Printf("loaded landing page %s", landingPageFile)
+	return nil
+}
+
+func getRoot(w http.ResponseWriter, r *http.Request) {
+	landingMu.RLock()
+	page, contentType := landingPage, landingContentType
+	landingMu.RUnlock()
+
+	if page == nil {
+		fmt.Fprintf(w, "%s %s\n%s\n", SOFTWARE, VERSION, GITHUB_URL)
+		return
+	}
+
+	// Rendered up front, so a broken template doesn't send half a page
+	var buf bytes.Buffer
+	err := page.Execute(&buf, landingData{
+		Name:     instanceName,
+		Contact:  contact,
+		Software: SOFTWARE,
+		Version:  VERSION,
+		URL:      GITHUB_URL,
+		Node:     nodeName,
+	})
+	if err != nil {
+		logger.Printf("error rendering landing page: %v", err)
+		http.Error(w, "error rendering landing page", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Write(buf.Bytes())
+}
+
+func getVersion(w http.ResponseWriter, r *http.Request) {
+	sendJSON(w, map[string]string{
+		"software": SOFTWARE,
+		"version":  VERSION,
+		"url":      GITHUB_URL,
+	})
+}
@@ -0,0 +1,81 @@
+package mediacache
+
+import (
+	"errors"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// CACHE_LISTEN is either a TCP address or unix:/path/to.sock. With a
+// certificate and key configured, HTTPS (and HTTP/2) is served instead.
+var (
+	tlsCert    string
+	tlsKey     string
+	socketMode fs.FileMode
+)
+
+func configureListen() {
+	tlsCert = getEnv("CACHE_TLS_CERT", "")
+	tlsKey = getEnv("CACHE_TLS_KEY", "")
+	socketMode = parseSocketMode(getEnv("CACHE_SOCKET_MODE", "0660"))
+	if (tlsCert == "") != (tlsKey == "") {
+		invalidConfig("CACHE_TLS_CERT and CACHE_TLS_KEY must be set together")
+	}
+}
+
+func parseSocketMode(value string) fs.FileMode {
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || mode > 0o777 {
+		invalidConfig("invalid value for CACHE_SOCKET_MODE: %s", value)
+	}
+	return fs.FileMode(mode)
+}
+
+func openListener(addr string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, "unix:")
+	if !ok {
+		return listenTCP(addr)
+	}
+
+	// A socket left behind by a crash would make Listen fail, but anything
+	// that isn't a socket is not ours to remove
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&fs.ModeSocket == 0 {
+			return nil, &fs.PathError{Op: "listen", Path: path, Err: fs.ErrExist}
+		}
+		err = os.Remove(path)
+		if err != nil {
+			return nil, err
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	// The socket is removed again when the listener is closed on shutdown
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	err = os.Chmod(path, socketMode)
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// serveListener serves srv on ln, over TLS if it is configured.
+func serveListener(srv *http.Server, ln net.Listener) func() error {
+	if tlsCert == "" && tlsKey == "" {
+		return func() error {
+			return srv.Serve(ln)
+		}
+	}
+	return func() error {
+		return srv.ServeTLS(ln, tlsCert, tlsKey)
+	}
+}
@@ -0,0 +1,180 @@
+package mediacache
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// lockable is a readers-writer lock per cache key that waiters can give up
+// on. A writer waiting keeps new readers out, as with sync.RWMutex.
+type lockable struct {
+	Stats
+
+	// state guards the fields below it
+	state          sync.Mutex
+	readers        int
+	writers        int
+	pendingWriters int
+	touched        time.Time
+	// released is closed, and replaced, whenever the lock is released or a
+	// writer gives up waiting, so waiters look again
+	released chan struct{}
+
+	refreshing atomic.Bool
+	waiting    atomic.Int64
+	warned     atomic.Int64
+}
+
+func (l *lockable) RLock() {
+	l.acquire(false, nil)
+}
+
+func (l *lockable) RUnlock() {
+	l.state.Lock()
+	l.readers--
+	l.wake()
+	l.state.Unlock()
+}
+
+func (l *lockable) Lock() {
+	l.acquire(true, nil)
+}
+
+func (l *lockable) Unlock() {
+	l.state.Lock()
+	l.writers--
+	l.wake()
+	l.state.Unlock()
+}
+
+// TryLock takes the write lock only if nobody is using the file.
+func (l *lockable) TryLock() bool {
+	l.state.Lock()
+	defer l.state.Unlock()
+	if l.readers > 0 || l.writers > 0 {
+		return false
+	}
+	l.writers++
+	l.touched = time.Now()
+	return true
+}
+
+const ErrLockTimeout = ErrorStr("timed out waiting for a busy object")
+
+// acquire takes the lock for reading or writing, or gives up once giveUp
+// fires. Nothing is left waiting after giving up.
+func (l *lockable) acquire(write bool, giveUp <-chan time.Time) bool {
+	l.state.Lock()
+	defer l.state.Unlock()
+	if write {
+		l.pendingWriters++
+		defer func() {
+			l.pendingWriters--
+		}()
+	}
+
+	for {
+		if write && l.readers == 0 && l.writers == 0 {
+			l.writers++
+			l.touched = time.Now()
+			return true
+		}
+		if !write && l.writers == 0 && l.pendingWriters == 0 {
+			l.readers++
+			l.touched = time.Now()
+			return true
+		}
+
+		if l.released == nil {
+			l.released = make(chan struct{})
+		}
+		released := l.released
+		l.state.Unlock()
+		select {
+		case <-released:
+			l.state.Lock()
+		case <-giveUp:
+			l.state.Lock()
+			if write {
+				// Readers held back for us can go ahead
+				l.wake()
+			}
+			return false
+		}
+	}
+}
+
+// wake lets waiters look at the lock again. state must be held.
+func (l *lockable) wake() {
+	if l.released != nil {
+		close(l.released)
+		l.released = nil
+	}
+}
+
+// RLockTimeout and LockTimeout are RLock and Lock giving up after timeout,
+// so a fetch that hangs can't hold up every request for its object. A
+// timeout of zero waits as long as it takes.
+func (l *lockable) RLockTimeout(timeout time.Duration) bool {
+	return l.acquireWithin(false, timeout)
+}
+
+func (l *lockable) LockTimeout(timeout time.Duration) bool {
+	return l.acquireWithin(true, timeout)
+}
+
+func (l *lockable) acquireWithin(write bool, timeout time.Duration) bool {
+	if timeout <= 0 {
+		return l.acquire(write, nil)
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	return l.acquire(write, timer.C)
+}
+
+// usage returns who holds the lock, and since when it was last taken.
+func (l *lockable) usage() (readers int, writers int, touched time.Time) {
+	l.state.Lock()
+	defer l.state.Unlock()
+	return l.readers, l.writers, l.touched
+}
+
+// lockTimedOut fails a request that gave up waiting for its object's lock,
+// asking the client to come back later. The first time out of a minute is
+// logged as a stuck key, along with how long the lock has been held.
+func lockTimedOut(w http.ResponseWriter, l *lockable) {
+	now := time.Now()
+	last := l.warned.Load()
+	if now.Sub(time.Unix(0, last)) > time.Minute && l.warned.CompareAndSwap(last, now.UnixNano()) {
+		readers, writers, touched := l.usage()
+		logger.Printf("stuck key %s: lock held for %v (%d writers, %d readers, %d waiting)",
+			l.Name, now.Sub(touched).Round(time.Second), writers, readers, l.waiting.Load())
+	}
+
+	w.Header().Set("Retry-After", strconv.FormatInt(int64(max(lockTimeout.Seconds(), 1)), 10))
+	failRequest(w, &l.Stats, ErrLockTimeout, 0, "waiting for "+l.Name)
+}
+
+// getLock returns the lock for a cache key, creating it if needed.
+func getLock(filename string) *lockable {
+	mutex.RLock()
+	lock, ok := locks[filename]
+	mutex.RUnlock()
+	if ok {
+		return lock
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	lock, ok = locks[filename]
+	if !ok {
+		lock = &lockable{}
+		lock.Name = filename
+		locks[filename] = lock
+	}
+	return lock
+}
@@ -0,0 +1,80 @@
+package mediacache
+
+import (
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestLockTimeoutLeavesNothingBehind(t *testing.T) {
+	var l lockable
+	l.Lock()
+
+	before := runtime.NumGoroutine()
+	for i := 0; i < 100; i++ {
+		if l.RLockTimeout(time.Millisecond) {
+			t.Fatal("RLockTimeout() took a lock held for writing")
+		}
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("%d goroutines left behind by timed out waiters", after-before)
+	}
+
+	l.Unlock()
+	if readers, writers, _ := l.usage(); readers != 0 || writers != 0 {
+		t.Fatalf("usage() = %d readers, %d writers after unlocking, want none", readers, writers)
+	}
+	if !l.TryLock() {
+		t.Fatal("TryLock() failed on a free lock")
+	}
+}
+
+func TestPendingWriterHoldsBackReaders(t *testing.T) {
+	var l lockable
+	l.RLock()
+
+	gaveUp := make(chan bool)
+	go func() {
+		gaveUp <- !l.LockTimeout(50 * time.Millisecond)
+	}()
+
+	// Wait for the writer to queue up
+	for {
+		l.state.Lock()
+		pending := l.pendingWriters
+		l.state.Unlock()
+		if pending > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if l.RLockTimeout(10 * time.Millisecond) {
+		t.Fatal("RLockTimeout() went ahead of a waiting writer")
+	}
+	if !<-gaveUp {
+		t.Fatal("LockTimeout() took a lock held for reading")
+	}
+	if !l.RLockTimeout(10 * time.Millisecond) {
+		t.Fatal("RLockTimeout() still held back after the writer gave up")
+	}
+	l.RUnlock()
+	l.RUnlock()
+}
+
+func TestUnlockWakesWaiter(t *testing.T) {
+	var l lockable
+	l.Lock()
+
+	acquired := make(chan bool)
+	go func() {
+		acquired <- l.LockTimeout(time.Second)
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	l.Unlock()
+	if !<-acquired {
+		t.Fatal("LockTimeout() gave up on a lock that was released")
+	}
+	l.Unlock()
+}
@@ -0,0 +1,96 @@
+package mediacache
+
+import (
+	"io"
+	"log"
+	"os"
+	"time"
+
+	mcstats "git.hajkey.org/hajkey/mediacache/internal/stats"
+	"git.hajkey.org/hajkey/mediacache/internal/store"
+)
+
+// Log timestamps are written in CACHE_LOG_TIMEZONE (UTC unless set to an
+// IANA zone name or "Local") using CACHE_LOG_TIME_FORMAT: rfc3339, with
+// fixed-width milliseconds so lines from several nodes sort correctly as
+// text, classic for the old 2006/01/02 15:04:05, or any Go time layout
+// showing at least the minute.
+// The same applies to the access log, except that the common format keeps
+// the layout it is defined with.
+var (
+	logTimeFormat string
+	logTimezone   *time.Location
+)
+
+// logger is the cache's own, so that embedding it leaves the standard
+// logger alone. Until configure sets it up, it logs the way the standard
+// logger does.
+var logger = log.New(os.Stderr, "", log.LstdFlags)
+
+func configureLogTime() {
+	logTimeFormat = parseLogTimeFormat(getEnv("CACHE_LOG_TIME_FORMAT", "rfc3339"))
+	logTimezone = loadLogTimezone(getEnv("CACHE_LOG_TIMEZONE", "UTC"))
+}
+
+func parseLogTimeFormat(format string) string {
+	switch format {
+	case "rfc3339":
+		return "2006-01-02T15:04:05.000Z07:00"
+	case "classic":
+		return "2006/01/02 15:04:05"
+	}
+	if !validLogTimeLayout(format) {
+		invalidConfig("invalid value for CACHE_LOG_TIME_FORMAT: %s", format)
+		return "2006-01-02T15:04:05.000Z07:00"
+	}
+	return format
+}
+
+// validLogTimeLayout tells whether layout is a Go time layout that shows
+// at least the minute, and parses back, so that a typo like "YYYY-MM-DD"
+// isn't taken as a constant string.
+func validLogTimeLayout(layout string) bool {
+	t := time.Date(2026, 1, 2, 15, 4, 5, 0, time.UTC)
+	if t.Format(layout) == t.Add(time.Minute).Format(layout) {
+		return false
+	}
+	_, err := time.Parse(layout, t.Format(layout))
+	return err == nil
+}
+
+func loadLogTimezone(name string) *time.Location {
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		invalidConfig("invalid value for CACHE_LOG_TIMEZONE: %v", err)
+		return time.UTC
+	}
+	return location
+}
+
+func logTime(t time.Time) string {
+	return t.In(logTimezone).Format(logTimeFormat)
+}
+
+// timestampWriter prefixes every log message with our own timestamp. The
+// log package hands each message over in a single Write.
+type timestampWriter struct {
+	out io.Writer
+}
+
+func (tw timestampWriter) Write(p []byte) (int, error) {
+	line := make([]byte, 0, len(p)+32)
+	line = append(line, logTime(time.Now())...)
+	line = append(line, ' ')
+	line = append(line, p...)
+	_, err := tw.out.Write(line)
+	return len(p), err
+}
+
+// setupLogTime points logger, and those of the internal packages, at out
+// with our timestamps.
+func setupLogTime(out io.Writer) {
+	logger.SetFlags(0)
+	logger.SetOutput(timestampWriter{out: out})
+	store.Logger = logger
+	mcstats.Logger = logger
+}
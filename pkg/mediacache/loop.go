@@ -0,0 +1,69 @@
+package mediacache
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Every upstream request carries a Via header naming this cache, after
+// whatever Via the client request came with, and requests that already
+// name us are refused with 508 Loop Detected. That catches a cache set up
+// as its own upstream, directly, through redirects or through other caches
+// that keep the Via header, instead of having the request go round until
+// something times out. CACHE_VIA_NAME has to be unique among the caches
+// involved; it defaults to CACHE_NODE_NAME.
+//
+// Redirects from upstreams are followed up to CACHE_UPSTREAM_MAX_REDIRECTS
+// times.
+var (
+	viaName              string
+	upstreamMaxRedirects int64
+)
+
+func configureLoop() {
+	upstreamMaxRedirects = getEnv[int64]("CACHE_UPSTREAM_MAX_REDIRECTS", 10)
+	viaName = getEnv("CACHE_VIA_NAME", nodeName)
+}
+
+type viaKey struct{}
+
+// withVia remembers the Via header of a client request, for the upstream
+// requests made on its behalf.
+func withVia(r *http.Request) *http.Request {
+	via := strings.Join(r.Header.Values("Via"), ", ")
+	if via == "" {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), viaKey{}, via))
+}
+
+// viaHeader is the Via header for an upstream request made with ctx.
+func viaHeader(ctx context.Context) string {
+	own := "1.1 " + viaName + " (" + SOFTWARE + ")"
+	if via, ok := ctx.Value(viaKey{}).(string); ok {
+		return via + ", " + own
+	}
+	return own
+}
+
+// isLoop reports whether a request has been through this cache before.
+func isLoop(r *http.Request) bool {
+	for _, value := range r.Header.Values("Via") {
+		for _, hop := range strings.Split(value, ",") {
+			fields := strings.Fields(hop)
+			if len(fields) >= 2 && fields[1] == viaName {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if int64(len(via)) > upstreamMaxRedirects {
+		return fmt.Errorf("stopped after %d redirects", upstreamMaxRedirects)
+	}
+	return nil
+}
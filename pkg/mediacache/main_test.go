@@ -0,0 +1,88 @@
+package mediacache
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// testCache is the one Cache of the test binary, fetching from testUpstream
+// into a temporary directory. Objects larger than 1KB are passed through,
+// and so is the first request for anything under /pass/.
+var (
+	testCache    *Cache
+	testUpstream *httptest.Server
+)
+
+// upstreamDown makes the test upstream fail names containing "flaky".
+var upstreamDown atomic.Bool
+
+// serveTestUpstream answers with the request URI it got, so tests can tell
+// exactly what reached the upstream. Names containing "large" get 4KB
+// instead, and names containing "chunked" are sent without a length. Names
+// containing "etag" come with one, and can be revalidated.
+func serveTestUpstream(w http.ResponseWriter, r *http.Request) {
+	if strings.Contains(r.URL.Path, "flaky") && upstreamDown.Load() {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+		return
+	}
+	if strings.Contains(r.URL.Path, "etag") {
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
+	body := []byte(r.RequestURI)
+	if strings.Contains(r.URL.Path, "large") {
+		body = bytes.Repeat([]byte("x"), 4096)
+	}
+	if strings.HasSuffix(r.URL.Path, ".svg") {
+		w.Header().Set("Content-Type", svgContentType)
+	}
+	if strings.Contains(r.URL.Path, "chunked") {
+		w.(http.Flusher).Flush()
+	} else {
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	w.Write(body)
+}
+
+func TestMain(m *testing.M) {
+	testUpstream = httptest.NewServer(http.HandlerFunc(serveTestUpstream))
+
+	dir, err := os.MkdirTemp("", "mediacache-test")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	testCache, err = New(Config{
+		Upstreams: []string{testUpstream.URL},
+		Dir:       dir,
+		Env: map[string]string{
+			"CACHE_ROUTES":          "/pass/=>" + testUpstream.URL + " admission=second-hit",
+			"CACHE_MAX_OBJECT_SIZE": "1KB",
+			"CACHE_SVG_POLICY":      "attachment",
+		},
+		LogOutput:         io.Discard,
+		IgnoreEnvironment: true,
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	code := m.Run()
+	testUpstream.Close()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
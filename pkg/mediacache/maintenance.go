@@ -0,0 +1,369 @@
+package mediacache
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+type fileInfo struct {
+	name  string
+	key   string
+	host  string
+	route *route
+	score float64
+	hot   float64
+	age   float64
+	size  float64
+	used  float64
+}
+
+// cleanCache evicts objects based on the in-memory index. Eviction starts
+// once the cache, a route with its own limits or a host with a quota is
+// above the high watermark and removes the highest scoring objects until it
+// is back under the low watermark. Objects that are being served are
+// skipped rather than waited for, so requests are never blocked. At most
+// limit objects are removed per run, unless limit is zero. Pinned objects
+// are never evicted.
+//
+// Expired objects are evicted for their age only if they can't be
+// revalidated. Those with an ETag or Last-Modified date stay until a request
+// revalidates them, until CACHE_MAX_STALE if set, or until they are evicted
+// to make room.
+//
+// reserve counts towards the cache's size, for room to be made for an
+// object about to be added. Only one run happens at a time.
+func cleanCache(limit int, reserve int64) {
+	cleanMu.Lock()
+	defer cleanMu.Unlock()
+
+	entries, totalBytes := index.Snapshot()
+
+	now := time.Now()
+	totalSize := float64(totalBytes+reserve) / 1024 / 1024
+	totalCount := int64(len(entries))
+	var fileList []fileInfo
+	var removed int
+
+	for name, entry := range entries {
+		if isPinned(entry.Key) {
+			continue
+		}
+
+		size := float64(entry.Size) / 1024 / 1024
+		age := now.Sub(entry.Retrieved).Hours()
+		used := now.Sub(entry.LastAccess).Hours()
+
+		maxEntryAge := maxAge + staleWhileRevalidate
+		if entry.Revalidatable {
+			maxEntryAge = 0
+			if maxStale > 0 {
+				maxEntryAge = max(maxStale, maxAge+staleWhileRevalidate)
+			}
+		}
+		if maxAge > 0 && maxEntryAge > 0 && age > maxEntryAge {
+			if limit > 0 && removed >= limit {
+				continue
+			}
+			if evictObject(name, entry.Key) {
+				removed++
+				logger.Printf("%s %s\n  (age: %.01fh > %.01fh)", evictVerb(), name, age, maxEntryAge)
+				totalSize -= size
+				totalCount--
+			}
+			continue
+		}
+
+		// big old file without recent reads score higher, popular ones
+		// lower, though popularity fades once the reads stop:
+		hot := entry.popularityAt(now)
+		score := size * age * used / (1 + hot)
+
+		fileList = append(fileList, fileInfo{
+			name:  name,
+			key:   entry.Key,
+			host:  entry.Host,
+			route: routeForKey(entry.Key),
+			score: score,
+			hot:   hot,
+			age:   age,
+			size:  size,
+			used:  used,
+		})
+	}
+
+	// Sort files by score
+	sort.Slice(fileList, func(i, j int) bool {
+		// Return highest scores first
+		return fileList[i].score > fileList[j].score
+	})
+
+	// Hosts over their quota, then routes with their own limits, give up
+	// their own objects first. Objects whose key isn't known yet count
+	// towards the default route.
+	evicted := make(map[string]bool)
+	evictGroup := func(name string, maxSize float64, maxFiles int64, member func(file fileInfo) bool) {
+		var files []fileInfo
+		for _, file := range fileList {
+			if member(file) && !evicted[file.name] {
+				files = append(files, file)
+			}
+		}
+		for _, file := range evictOver(name, files, maxSize, maxFiles, limit, &removed) {
+			evicted[file.name] = true
+			totalSize -= file.size
+			totalCount--
+		}
+	}
+
+	for host := range index.Hosts() {
+		quota := quotaFor(host)
+		if quota <= 0 {
+			continue
+		}
+		evictGroup("host "+host, float64(quota)/1024/1024, 0, func(file fileInfo) bool {
+			return file.host == host
+		})
+	}
+	for _, rt := range routes {
+		if rt.maxSize <= 0 && rt.maxFiles <= 0 {
+			continue
+		}
+		evictGroup("route "+rt.host+rt.prefix, rt.maxSize, rt.maxFiles, func(file fileInfo) bool {
+			return file.route == rt
+		})
+	}
+
+	highSize := maxCacheSize * float64(evictHighWatermark) / 100
+	highCount := maxCacheFiles * evictHighWatermark / 100
+	if totalSize <= highSize && totalCount <= highCount {
+		return
+	}
+
+	logger.Printf(
+		"cache size: %.01f/%.01fMb (%d/%d files)",
+		totalSize, maxCacheSize,
+		totalCount, maxCacheFiles,
+	)
+
+	remaining := fileList[:0]
+	for _, file := range fileList {
+		if !evicted[file.name] {
+			remaining = append(remaining, file)
+		}
+	}
+
+	// Remove files until we're under the low watermark
+	lowSize := maxCacheSize * float64(evictLowWatermark) / 100
+	lowCount := maxCacheFiles * evictLowWatermark / 100
+	evictFiles(remaining, totalSize, totalCount, lowSize, lowCount, limit, &removed)
+}
+
+var cleanMu sync.Mutex
+
+// makeRoom evicts before name is stored with size bytes, if that would take
+// the cache above its high watermark. Fills can't grow the cache past its
+// limit between cleanings that way, and waiting for a lot of evictions is
+// avoided by stopping after CACHE_EVICT_BATCH.
+func makeRoom(name string, size int64) {
+	if !cacheClean || maxCacheSize <= 0 {
+		return
+	}
+	// A new copy replaces the old one
+	total, own := index.Size(name)
+	growth := size - own
+	if float64(total+growth)/1024/1024 <= maxCacheSize*float64(evictHighWatermark)/100 {
+		return
+	}
+	cleanCache(int(evictBatch), growth)
+}
+
+// evictOver evicts files, a group with its own limits, once it is above
+// the high watermark of them. A limit of zero doesn't apply.
+func evictOver(name string, files []fileInfo, maxSize float64, maxFiles int64, limit int, removed *int) []fileInfo {
+	var size float64
+	for _, file := range files {
+		size += file.size
+	}
+	count := int64(len(files))
+
+	if maxSize <= 0 {
+		maxSize = size
+	}
+	if maxFiles <= 0 {
+		maxFiles = count
+	}
+	if size <= maxSize*float64(evictHighWatermark)/100 && count <= maxFiles*evictHighWatermark/100 {
+		return nil
+	}
+
+	logger.Printf(
+		"%s size: %.01f/%.01fMb (%d/%d files)",
+		name,
+		size, maxSize,
+		count, maxFiles,
+	)
+	lowSize := maxSize * float64(evictLowWatermark) / 100
+	lowCount := maxFiles * evictLowWatermark / 100
+	return evictFiles(files, size, count, lowSize, lowCount, limit, removed)
+}
+
+// evictFiles removes files in order until size and count are down to
+// lowSize and lowCount, or limit files have been removed in this run. It
+// returns the files it removed.
+func evictFiles(files []fileInfo, size float64, count int64, lowSize float64, lowCount int64, limit int, removed *int) (evicted []fileInfo) {
+	for _, file := range files {
+		if size <= lowSize && count <= lowCount {
+			break
+		}
+		if limit > 0 && *removed >= limit {
+			logger.Printf("eviction paused after %d files, waiting for next run", *removed)
+			break
+		}
+
+		if !evictObject(file.name, file.key) {
+			continue
+		}
+		*removed++
+		size -= file.size
+		count--
+		evicted = append(evicted, file)
+
+		logger.Printf(
+			"%s %s\n"+
+				"  age: %.01fh size: %.01fMb  used: %.01fh  hot: %.01f\n"+
+				"  (%d / %d files / %0.01f / %0.01fMb, score: %.03f)",
+			evictVerb(), file.name,
+			file.age, file.size, file.used, file.hot,
+			count, lowCount,
+			size, lowSize,
+			file.score,
+		)
+	}
+	return evicted
+}
+
+func evictVerb() string {
+	if dryRun {
+		return "would remove"
+	}
+	return "removing"
+}
+
+// evictObject removes an object unless it is currently in use. It reports
+// whether the object was (or in dry-run mode, would have been) removed.
+func evictObject(name string, key string) bool {
+	if dryRun {
+		return true
+	}
+
+	if key != "" {
+		mutex.RLock()
+		lock, ok := locks[key]
+		mutex.RUnlock()
+		if ok {
+			if !lock.TryLock() {
+				return false
+			}
+			defer lock.Unlock()
+		}
+	}
+
+	err := removeObject(name)
+	if err != nil {
+		logger.Printf("error removing %s: %v", name, err)
+	}
+	return true
+}
+
+func reportStats() {
+	mutex.Lock()
+	for filename, lock := range locks {
+		extra := ""
+		readers, writers, touched := lock.usage()
+		if readers == 0 && writers == 0 && time.Since(touched) > 10*time.Minute {
+			delete(locks, filename)
+			extra = " (expired)"
+		}
+		lock.Report(extra)
+	}
+	mutex.Unlock()
+}
+
+// checkCleanInterval makes sure eviction runs on one of maintain's ticks.
+func checkCleanInterval(interval time.Duration) time.Duration {
+	if interval < time.Minute {
+		invalidConfig("invalid value for CACHE_CLEAN_INTERVAL: %v, the minimum is 1m", interval)
+		return time.Hour
+	}
+	return interval
+}
+
+// maintain runs periodic housekeeping. Light work happens every minute;
+// full index rebuilds, scrubs and unbounded eviction passes are held back
+// for the maintenance window when one is configured.
+//
+// Eviction runs every CACHE_CLEAN_INTERVAL, an hour by default. With the
+// in-memory index a pass is cheap enough to run as often as every minute,
+// which keeps the cache closer to its limits at the cost of evicting
+// expired objects without validators sooner.
+func maintain() {
+	index.Load()
+	// Eviction needs the keys, to leave pinned objects alone and apply
+	// route limits
+	index.fillFromMeta()
+	if cacheClean {
+		cleanCache(0, 0)
+	}
+
+	cleanEvery := int(cleanInterval / time.Minute)
+	tock := time.NewTicker(60 * time.Second)
+	c := 0
+	heavyDone := false
+	lastScrub := time.Now()
+	for range tock.C {
+		c++
+		inWindow := inMaintenanceWindow()
+
+		if c%10 == 0 {
+			checkLeaks()
+			pruneRateBuckets()
+			if printStats {
+				reportStats()
+			}
+		}
+		if cacheClean && c%cleanEvery == 0 {
+			if inWindow {
+				cleanCache(0, 0)
+			} else {
+				cleanCache(int(evictBatch), 0)
+			}
+		}
+		if maintenance != nil {
+			if inWindow && !heavyDone {
+				logger.Print("maintenance window: rebuilding index")
+				err := index.Rebuild()
+				if err != nil {
+					logger.Printf("error rebuilding index: %v", err)
+				}
+				index.fillFromMeta()
+				heavyDone = true
+			} else if !inWindow {
+				heavyDone = false
+			}
+		}
+		// Scrubbing reads the whole cache, so it waits for the window too
+		if scrubInterval > 0 && time.Since(lastScrub) >= scrubInterval && (maintenance == nil || inWindow) {
+			scrubCache()
+			lastScrub = time.Now()
+		}
+		if c%10 == 0 {
+			index.Save()
+		}
+		if printStats {
+			stats.Report()
+		}
+		reportRoutes()
+		reportUpstream()
+	}
+}
@@ -0,0 +1,69 @@
+package mediacache
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"git.hajkey.org/hajkey/mediacache/internal/cachekey"
+)
+
+func TestCleanCacheKeepsRevalidatable(t *testing.T) {
+	srv := httptest.NewServer(testCache)
+	defer srv.Close()
+
+	unique := strconv.FormatInt(time.Now().UnixNano(), 36)
+	tests := []struct {
+		name   string
+		target string
+		kept   bool
+	}{
+		{"with validators", "/etag-" + unique + ".png", true},
+		{"without validators", "/plain-" + unique + ".png", false},
+	}
+
+	for _, tt := range tests {
+		get(t, srv, tt.target)
+
+		index.mu.Lock()
+		index.entries[cachekey.Hash(tt.target)].Retrieved = time.Now().Add(-24 * time.Hour)
+		index.mu.Unlock()
+	}
+
+	cleanCache(0, 0)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if kept := checkExists(tt.target); kept != tt.kept {
+				t.Errorf("kept = %v, want %v", kept, tt.kept)
+			}
+		})
+	}
+}
+
+func TestMakeRoom(t *testing.T) {
+	srv := httptest.NewServer(testCache)
+	defer srv.Close()
+
+	unique := strconv.FormatInt(time.Now().UnixNano(), 36)
+	for _, target := range []string{"/room-a-" + unique + ".png", "/room-b-" + unique + ".png"} {
+		get(t, srv, target)
+	}
+
+	saved := maxCacheSize
+	defer func() { maxCacheSize = saved }()
+	total, _ := index.Size("")
+	maxCacheSize = float64(total) / 1024 / 1024
+
+	makeRoom(cachekey.Hash("/room-new-"+unique+".png"), 0)
+	if after, _ := index.Size(""); after != total {
+		t.Fatalf("size = %d after making room that was there, want %d", after, total)
+	}
+
+	makeRoom(cachekey.Hash("/room-new-"+unique+".png"), 1)
+	after, _ := index.Size("")
+	if low := int64(maxCacheSize * float64(evictLowWatermark) / 100 * 1024 * 1024); after+1 > low {
+		t.Errorf("size = %d after making room, want at most %d", after+1, low)
+	}
+}
@@ -0,0 +1,259 @@
+// Package mediacache is a caching reverse proxy for media files.
+//
+// It is configured through CACHE_* environment variables, the same way the
+// mediacache binary is; a Config passed to New overrides them. Nothing is
+// read before New, so importing the package has no side effects.
+//
+// The cache keeps its settings and state in package-level variables, so
+// there can only be one Cache per process: a second New fails with
+// ErrAlreadyCreated, and tests that need another configuration have to run
+// in a process of their own. ConvertMeta, ExportList and ImportList read
+// the settings the same way, once, so calling one of them before New leaves
+// New's Config unused.
+package mediacache
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ErrAlreadyCreated is returned by New after the first call.
+const ErrAlreadyCreated = ErrorStr("a cache has already been created in this process")
+
+// Config overrides the environment. Zero values keep the setting from the
+// environment, or its default.
+type Config struct {
+	// Upstreams to fetch from, tried according to CACHE_UPSTREAM_STRATEGY,
+	// for requests that don't match any of CACHE_ROUTES.
+	Upstreams []string
+	// Storage is "disk" or "s3".
+	Storage string
+	// Dir is where the disk storage keeps objects.
+	Dir string
+
+	MaxFiles int64
+	// MaxSizeMB is in binary megabytes (MiB), as are sizes in the
+	// environment.
+	MaxSizeMB   float64
+	MaxAgeHours float64
+
+	// Listen is the address used by ListenAndServe.
+	Listen string
+
+	// Env sets any other CACHE_* setting, as it would be spelled in the
+	// environment. The fields above win over it.
+	Env map[string]string
+	// LogOutput receives the log, os.Stderr if nil. The standard logger is
+	// left alone either way.
+	LogOutput io.Writer
+	// IgnoreEnvironment leaves the process environment out, so only Config
+	// and the defaults count.
+	IgnoreEnvironment bool
+
+	// Middleware adds middlewares under their names, for CACHE_MIDDLEWARE
+	// and the middleware option of CACHE_ROUTES to list next to the
+	// built-in ones. A name that is already taken replaces the built-in
+	// middleware.
+	Middleware map[string]Middleware
+}
+
+// A Middleware wraps the cache handler, and decides whether a request goes
+// through to next. It may also change the request on the way, the way the
+// signature middleware takes the signing parameters out of the query.
+type Middleware func(next http.Handler) http.Handler
+
+// settings spells config the way the environment would.
+func (config Config) settings() map[string]string {
+	settings := make(map[string]string, len(config.Env))
+	for key, value := range config.Env {
+		settings[key] = value
+	}
+	if len(config.Upstreams) > 0 {
+		settings["CACHE_UPSTREAM"] = strings.Join(config.Upstreams, " ")
+	}
+	if config.Storage != "" {
+		settings["CACHE_STORAGE"] = config.Storage
+	}
+	if config.Dir != "" {
+		settings["CACHE_DIR"] = config.Dir
+	}
+	if config.MaxFiles != 0 {
+		settings["CACHE_MAX_FILES"] = strconv.FormatInt(config.MaxFiles, 10)
+	}
+	if config.MaxSizeMB != 0 {
+		settings["CACHE_MAX_SIZE"] = formatSize(int64(config.MaxSizeMB * (1 << 20)))
+	}
+	if config.MaxAgeHours != 0 {
+		settings["CACHE_MAX_AGE"] = (time.Duration(config.MaxAgeHours * float64(time.Hour))).String()
+	}
+	if config.Listen != "" {
+		settings["CACHE_LISTEN"] = config.Listen
+	}
+	return settings
+}
+
+// Cache serves cached media over HTTP.
+type Cache struct {
+	handler http.Handler
+}
+
+// StatsSnapshot holds the totals since startup.
+type StatsSnapshot struct {
+	Requests      uint64
+	Completed     uint64
+	Disconnects   uint64
+	SentBytes     uint64
+	ReceivedBytes uint64
+	Hits          uint64
+	HitBytes      uint64
+	Misses        uint64
+	MissBytes     uint64
+	Errors        uint64
+	SlowReads     uint64
+	Corrupt       uint64
+	Limited       uint64
+	MemHits       uint64
+	DiskHits      uint64
+	Abandoned     uint64
+
+	DigestFailures uint64
+	Quarantined    uint64
+	BadSignatures  uint64
+}
+
+var created atomic.Bool
+
+// New sets up the cache and starts its background maintenance. It can only
+// be called once per process; see the package documentation.
+func New(config Config) (*Cache, error) {
+	if !created.CompareAndSwap(false, true) {
+		return nil, ErrAlreadyCreated
+	}
+
+	err := configure(config)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Printf("upstreams: %s", strings.Join(upstreams, ", "))
+	logger.Printf("storage: %s", storageKind)
+	logger.Printf("cache dir: %s", cacheDir)
+	for _, rt := range routes {
+		logger.Printf("route: %s%s => %s", rt.host, rt.prefix, upstreamURLs(rt.upstreams))
+	}
+	if admission != "all" {
+		logger.Printf("admission: %s within %v", admission, admissionWindow)
+	}
+	if maxFetches > 0 && fetchQueueTimeout > 0 {
+		logger.Printf("fetch queue: %d slots, misses wait up to %v by priority", maxFetches, fetchQueueTimeout)
+	}
+	if chaos {
+		logger.Printf("chaos mode: %d%% fetches delayed by %v, %d%% fetches and %d%% disk operations fail",
+			chaosLatencyPercent, chaosLatency, chaosFetchErrorPercent, chaosDiskErrorPercent)
+	}
+
+	err = setupAccessLog()
+	if err != nil {
+		return nil, fmt.Errorf("error opening access log: %w", err)
+	}
+	err = loadBlocklist()
+	if err != nil {
+		return nil, fmt.Errorf("error loading blocklist: %w", err)
+	}
+	err = loadPins()
+	if err != nil {
+		return nil, fmt.Errorf("error loading pin list: %w", err)
+	}
+	err = loadLandingPage()
+	if err != nil {
+		return nil, fmt.Errorf("error loading landing page: %w", err)
+	}
+	err = loadHistory()
+	if err != nil {
+		return nil, fmt.Errorf("error loading stats history: %w", err)
+	}
+	err = loadMissJournal()
+	if err != nil {
+		return nil, fmt.Errorf("error loading miss journal: %w", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", withAccessLog(withMiddleware(withRouteStats(handleCache))))
+	mux.HandleFunc("/healthz", getHealthz)
+	mux.HandleFunc("/version", getVersion)
+	err = setupAdmin(mux)
+	if err != nil {
+		return nil, err
+	}
+	reloadOnHangup()
+
+	go maintain()
+	go monitorUpstreams()
+	go warmCache()
+	go measureIngress()
+	go sampleHistory()
+
+	return &Cache{handler: mux}, nil
+}
+
+// ServeHTTP serves cached objects, along with the health check and, if
+// configured, the admin API.
+func (c *Cache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.handler.ServeHTTP(w, r)
+}
+
+// ListenAndServe serves the cache on the configured address until SIGTERM
+// or SIGINT, then shuts down gracefully.
+func (c *Cache) ListenAndServe() error {
+	ln, err := openListener(listen)
+	if err != nil {
+		return err
+	}
+	logger.Printf("listening on %s", listen)
+
+	srv := &http.Server{Addr: listen, Handler: c}
+	return runServer(srv, serveListener(srv, ln))
+}
+
+// Purge removes an object, given by its path and query the way it appears
+// in URLs.
+func (c *Cache) Purge(path string) error {
+	return purgeObject(path)
+}
+
+// Prefetch caches the given paths, unless they are cached already. It
+// returns once all of them have been fetched.
+func (c *Cache) Prefetch(paths ...string) {
+	prefetch(paths).Wait()
+}
+
+// Stats returns the totals since startup.
+func (c *Cache) Stats() StatsSnapshot {
+	return StatsSnapshot{
+		Requests:      stats.Requests,
+		Completed:     stats.Completed,
+		Disconnects:   stats.Disconnects,
+		SentBytes:     stats.SentBytes,
+		ReceivedBytes: stats.ReceivedBytes,
+		Hits:          stats.Hits,
+		HitBytes:      stats.HitBytes,
+		Misses:        stats.Misses,
+		MissBytes:     stats.MissBytes,
+		Errors:        stats.Errors,
+		SlowReads:     stats.SlowReads,
+		Corrupt:       stats.Corrupt,
+		Limited:       stats.Limited,
+		MemHits:       stats.MemHits,
+		DiskHits:      stats.DiskHits,
+		Abandoned:     stats.Abandoned,
+
+		DigestFailures: stats.DigestFailures,
+		Quarantined:    stats.Quarantined,
+		BadSignatures:  stats.BadSignatures,
+	}
+}
@@ -0,0 +1,132 @@
+package mediacache
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"sync"
+)
+
+// The memory tier keeps small, frequently requested objects and their
+// parsed metadata in an LRU, so avatars and emoji don't cost a disk read
+// (and a meta decode) each. Objects are promoted after CACHE_MEM_PROMOTE_HITS
+// hits from disk and dropped whenever they change on disk.
+var (
+	memSize        int64
+	memMaxObject   int64
+	memPromoteHits int64
+
+	memTier = &memCache{
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+)
+
+func configureMemTier() {
+	memSize = getSize("CACHE_MEM_SIZE", "CACHE_MEM_SIZE_MB", 1<<20, 0)
+	memMaxObject = getSize("CACHE_MEM_MAX_OBJECT", "CACHE_MEM_MAX_OBJECT_KB", 1<<10, 64<<10)
+	memPromoteHits = getEnv[int64]("CACHE_MEM_PROMOTE_HITS", 2)
+}
+
+type memEntry struct {
+	name string
+	meta fileMeta
+	data []byte
+}
+
+type memCache struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	size    int64
+}
+
+// memReader serves an object from memory where a file is expected.
+type memReader struct {
+	*bytes.Reader
+}
+
+func (memReader) Close() error {
+	return nil
+}
+
+func (m *memCache) Has(name string) bool {
+	if memSize <= 0 {
+		return false
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, ok := m.entries[name]
+	return ok
+}
+
+// Get returns the object's metadata and a reader for its data.
+func (m *memCache) Get(name string) (meta fileMeta, file io.ReadSeekCloser, ok bool) {
+	if memSize <= 0 {
+		return meta, nil, false
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	elem, ok := m.entries[name]
+	if !ok {
+		return meta, nil, false
+	}
+	m.lru.MoveToFront(elem)
+
+	entry := elem.Value.(*memEntry)
+	return entry.meta, memReader{bytes.NewReader(entry.data)}, true
+}
+
+// Promote reads an object into memory if it qualifies.
+func (m *memCache) Promote(name string, meta fileMeta, hits uint64) {
+	if memSize <= 0 || meta.Size > memMaxObject || int64(hits) < memPromoteHits || m.Has(name) {
+		return
+	}
+
+	file, err := storage.Open(name)
+	if err != nil {
+		return
+	}
+	data, err := io.ReadAll(io.LimitReader(file, memMaxObject+1))
+	file.Close()
+	if err != nil || int64(len(data)) != meta.Size {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.entries[name]; ok {
+		return
+	}
+	m.entries[name] = m.lru.PushFront(&memEntry{name: name, meta: meta, data: data})
+	m.size += int64(len(data))
+
+	for m.size > memSize {
+		m.removeElement(m.lru.Back())
+	}
+}
+
+// Remove drops an object, e.g. because it changed on disk.
+func (m *memCache) Remove(name string) {
+	if memSize <= 0 {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if elem, ok := m.entries[name]; ok {
+		m.removeElement(elem)
+	}
+}
+
+func (m *memCache) removeElement(elem *list.Element) {
+	entry := m.lru.Remove(elem).(*memEntry)
+	delete(m.entries, entry.name)
+	m.size -= int64(len(entry.data))
+}
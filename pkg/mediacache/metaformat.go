@@ -0,0 +1,102 @@
+package mediacache
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+)
+
+// Binary meta files start with a format byte that can never begin a JSON
+// document, so both formats can be read no matter which one is configured.
+const metaFormatGob = 0x01
+
+var metaFormat string
+
+func configureMetaFormat() {
+	metaFormat = checkMetaFormat(getEnv("CACHE_META_FORMAT", "json"))
+}
+
+func checkMetaFormat(format string) string {
+	switch format {
+	case "json", "gob":
+		return format
+	}
+	invalidConfig("invalid value for CACHE_META_FORMAT: %s", format)
+	return ""
+}
+
+func encodeMeta(meta fileMeta, format string) ([]byte, error) {
+	if format == "gob" {
+		var buf bytes.Buffer
+		buf.WriteByte(metaFormatGob)
+		err := gob.NewEncoder(&buf).Encode(meta)
+		return buf.Bytes(), err
+	}
+
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+func decodeMeta(data []byte) (meta fileMeta, err error) {
+	if len(data) > 0 && data[0] == metaFormatGob {
+		err = gob.NewDecoder(bytes.NewReader(data[1:])).Decode(&meta)
+		return meta, err
+	}
+
+	err = json.Unmarshal(data, &meta)
+	return meta, err
+}
+
+// ConvertMeta rewrites every meta file in the cache in the given format,
+// json or gob.
+func ConvertMeta(format string) error {
+	err := configure(Config{})
+	if err != nil {
+		return err
+	}
+	switch format {
+	case "json", "gob":
+	default:
+		return fmt.Errorf("unknown meta format %s", format)
+	}
+
+	objects, err := storage.List()
+	if err != nil {
+		return err
+	}
+
+	var converted, failed int
+	for _, obj := range objects {
+		if obj.MetaTime.IsZero() {
+			continue
+		}
+
+		data, err := storage.ReadMeta(obj.Name)
+		if err == nil {
+			var meta fileMeta
+			meta, err = decodeMeta(data)
+			if err == nil {
+				data, err = encodeMeta(meta, format)
+			}
+			if err == nil {
+				err = storage.WriteMeta(obj.Name, data)
+			}
+		}
+		if err != nil {
+			logger.Printf("error converting %s: %v", obj.Name, err)
+			failed++
+			continue
+		}
+		converted++
+	}
+
+	logger.Printf("converted %d meta files to %s (%d failed)", converted, format, failed)
+	if failed > 0 {
+		return fmt.Errorf("%d meta files could not be converted", failed)
+	}
+	return nil
+}
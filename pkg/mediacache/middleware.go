@@ -0,0 +1,170 @@
+package mediacache
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Middlewares wrap the cache handler to decide whether a request may go
+// through. They are looked up by name, so deployments can stack them in
+// whatever order they need, and routes can have their own chain:
+//
+//	CACHE_MIDDLEWARE=ipacl,signature,ratelimit
+//	CACHE_ROUTES="/private/=>https://a.example.com middleware=ipacl,jwt,ratelimit,/open/=>https://b.example.com middleware="
+//
+// The first middleware listed sees the request first. A route's chain
+// replaces the default one entirely. The default is signature,ratelimit;
+// signature lets everything through unless CACHE_SIGNING_KEY is set.
+// Applications using the package can add their own through
+// Config.Middleware.
+var builtinMiddleware = map[string]func(next http.HandlerFunc) http.HandlerFunc{
+	"ratelimit": withRateLimit,
+	"ipacl":     withIPACL,
+	"signature": withSignature,
+	"jwt":       withJWT,
+}
+
+var (
+	customMiddleware map[string]Middleware
+	middlewares      map[string]Middleware
+
+	middlewareChain string
+
+	ipAllow []*net.IPNet
+	ipDeny  []*net.IPNet
+)
+
+func configureMiddleware() {
+	middlewares = make(map[string]Middleware, len(builtinMiddleware)+len(customMiddleware))
+	for name, m := range builtinMiddleware {
+		middlewares[name] = adaptMiddleware(m)
+	}
+	for name, m := range customMiddleware {
+		middlewares[name] = m
+	}
+
+	middlewareChain = getEnv("CACHE_MIDDLEWARE", "signature,ratelimit")
+	ipAllow = parseNetworks("CACHE_IP_ALLOW", getEnv("CACHE_IP_ALLOW", ""))
+	ipDeny = parseNetworks("CACHE_IP_DENY", getEnv("CACHE_IP_DENY", ""))
+
+	checkChain("CACHE_MIDDLEWARE", middlewareChain)
+
+	// Ignoring it would drop access control
+	if getEnv("CACHE_MIDDLEWARE_ROUTES", "") != "" {
+		invalidConfig("CACHE_MIDDLEWARE_ROUTES is replaced by the middleware option of CACHE_ROUTES")
+	}
+}
+
+// adaptMiddleware makes a built-in middleware a Middleware.
+func adaptMiddleware(m func(next http.HandlerFunc) http.HandlerFunc) Middleware {
+	return func(next http.Handler) http.Handler {
+		return m(next.ServeHTTP)
+	}
+}
+
+// chainIncludes tells whether the comma-separated middlewares include name.
+func chainIncludes(names string, name string) bool {
+	for _, listed := range strings.Split(names, ",") {
+		if strings.TrimSpace(listed) == name {
+			return true
+		}
+	}
+	return false
+}
+
+func checkChain(key string, names string) {
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if _, ok := middlewares[name]; name != "" && !ok {
+			invalidConfig("invalid value for %s: unknown middleware %s", key, name)
+		}
+		// It would let everything through
+		if _, custom := customMiddleware[name]; name == "jwt" && !custom && !jwtConfigured() {
+			invalidConfig("%s includes jwt, but neither CACHE_JWT_KEY nor CACHE_JWT_PUBLIC_KEY is set", key)
+		}
+	}
+}
+
+// chain wraps handler in the comma-separated middlewares, which
+// checkChain has checked.
+func chain(names string, handler http.Handler) http.Handler {
+	list := strings.Split(names, ",")
+	for i := len(list) - 1; i >= 0; i-- {
+		name := strings.TrimSpace(list[i])
+		if name == "" {
+			continue
+		}
+		handler = middlewares[name](handler)
+	}
+	return handler
+}
+
+// withMiddleware builds each route's chain around handler, and sends
+// requests through the one for their route.
+func withMiddleware(handler http.HandlerFunc) http.HandlerFunc {
+	chains := map[*route]http.Handler{defaultRoute: chain(defaultRoute.middleware, handler)}
+	for _, rt := range routes {
+		chains[rt] = chain(rt.middleware, handler)
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		chains[routeFor(r.Host, r.URL.Path)].ServeHTTP(w, r)
+	}
+}
+
+func withRateLimit(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if ok, retryAfter := allowRequest(clientIP(r)); !ok {
+			logger.Printf("rate limiting %s", clientIP(r))
+			stats.Limited++
+			sendTooMany(w, retryAfter, "too many requests")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// parseNetworks reads a list of IPs and CIDR ranges, separated by commas or
+// spaces.
+func parseNetworks(key string, value string) (networks []*net.IPNet) {
+	for _, entry := range strings.Fields(strings.ReplaceAll(value, ",", " ")) {
+		if !strings.Contains(entry, "/") {
+			if strings.Contains(entry, ":") {
+				entry += "/128"
+			} else {
+				entry += "/32"
+			}
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			invalidConfig("invalid value for %s: %v", key, err)
+			continue
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// withIPACL rejects clients in CACHE_IP_DENY, and, if CACHE_IP_ALLOW is
+// set, everyone not in it.
+func withIPACL(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ip := net.ParseIP(clientIP(r))
+		if ip == nil || containsIP(ipDeny, ip) || (len(ipAllow) > 0 && !containsIP(ipAllow, ip)) {
+			logger.Printf("refusing request from %s, not allowed by ACL", clientIP(r))
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
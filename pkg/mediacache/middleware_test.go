@@ -0,0 +1,79 @@
+package mediacache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// tracing is a middleware that records its name in the X-Chain header.
+func tracing(name string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("X-Chain", name)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func TestRouteMiddleware(t *testing.T) {
+	saved, savedDefault, savedMiddlewares, savedChain := routes, defaultRoute, middlewares, middlewareChain
+	defer func() {
+		routes, defaultRoute, middlewares, middlewareChain = saved, savedDefault, savedMiddlewares, savedChain
+	}()
+
+	middlewares = map[string]Middleware{"a": tracing("a"), "b": tracing("b"), "c": tracing("c")}
+	middlewareChain = "a"
+	routes = parseRoutes("/private/=>https://a.example.com middleware=b, c," +
+		"/open/=>https://b.example.com middleware=," +
+		"/plain/=>https://c.example.com admission=all," +
+		"img.example.com/=>https://img.example.com middleware=c,b")
+	defaultRoute = &route{middleware: middlewareChain}
+
+	handler := withMiddleware(func(w http.ResponseWriter, r *http.Request) {})
+
+	tests := []struct {
+		host   string
+		target string
+		want   string
+	}{
+		{"cache.example.com", "/a.png", "a"},
+		{"cache.example.com", "/private/a.png", "b,c"},
+		{"cache.example.com", "/open/a.png", ""},
+		{"cache.example.com", "/plain/a.png", "a"},
+		{"img.example.com", "/private/a.png", "c,b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host+tt.target, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", tt.target, nil)
+			r.Host = tt.host
+			handler(w, r)
+			if got := strings.Join(w.Header().Values("X-Chain"), ","); got != tt.want {
+				t.Errorf("chain = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitRoutes(t *testing.T) {
+	tests := []struct {
+		value string
+		want  []string
+	}{
+		{"/a/=>https://a.example.com,/b/=>https://b.example.com", []string{"/a/=>https://a.example.com", "/b/=>https://b.example.com"}},
+		{"/a/=>https://a.example.com middleware=ipacl, signature,/b/=>https://b.example.com", []string{"/a/=>https://a.example.com middleware=ipacl,signature", "/b/=>https://b.example.com"}},
+		{"/a/=>https://a.example.com middleware=,/b/=>https://b.example.com", []string{"/a/=>https://a.example.com middleware=", "/b/=>https://b.example.com"}},
+		{"/a/=>https://a.example.com,garbage", []string{"/a/=>https://a.example.com", "garbage"}},
+		{" , /a/=>https://a.example.com ,", []string{"/a/=>https://a.example.com"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got := splitRoutes(tt.value)
+			if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+				t.Errorf("splitRoutes() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
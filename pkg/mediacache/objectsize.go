@@ -0,0 +1,57 @@
+package mediacache
+
+const ErrTooLarge = ErrorStr("upstream response too large to cache")
+
+var ErrOverlong error = classedError{ErrIntegrity, "upstream response longer than its Content-Length"}
+
+// What happens to objects too large to cache:
+//
+//   - passthrough: they are streamed from the upstream without being stored
+//   - reject: the request fails
+var (
+	maxObjectSize  float64
+	oversizePolicy string
+)
+
+func configureObjectSize() {
+	maxObjectSize = float64(getSize("CACHE_MAX_OBJECT_SIZE", "CACHE_MAX_OBJECT_SIZE_MB", 1<<20, 0)) / (1 << 20)
+	oversizePolicy = checkOversizePolicy(getEnv("CACHE_OVERSIZE", "passthrough"))
+}
+
+func checkOversizePolicy(policy string) string {
+	switch policy {
+	case "passthrough", "reject":
+		return policy
+	}
+	invalidConfig("invalid value for CACHE_OVERSIZE: %s", policy)
+	return ""
+}
+
+// objectLimit is the largest object we are willing to store, in bytes, or
+// zero if there is no limit. Nothing larger than the whole cache is stored
+// even without a configured maximum, as it would only evict everything else
+// and then itself.
+func objectLimit() int64 {
+	limit := maxObjectSize
+	if limit <= 0 || (maxCacheSize > 0 && maxCacheSize < limit) {
+		limit = maxCacheSize
+	}
+	return int64(limit * 1024 * 1024)
+}
+
+// bodyLimit is how many bytes may be read from an upstream response before
+// storing it is given up on: its declared length, or the object limit for
+// responses that don't declare one. It is negative if there is no limit.
+func bodyLimit(contentLength int64) (limit int64, err error) {
+	limit = objectLimit()
+	if limit > 0 && contentLength > limit {
+		return 0, ErrTooLarge
+	}
+	if contentLength >= 0 {
+		return contentLength, nil
+	}
+	if limit == 0 {
+		return -1, nil
+	}
+	return limit, nil
+}
@@ -0,0 +1,152 @@
+package mediacache
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const ErrPartial = ErrorStr("upstream sent a partial response")
+
+// We never ask for ranges when filling the cache, but misconfigured origins
+// answer some full GETs with 206 anyway. Caching that as the whole object
+// would serve truncated files, so the rest is fetched with follow-up range
+// requests (reassemble), or the response isn't cached at all (refuse).
+var upstreamPartial string
+
+func configurePartial() {
+	upstreamPartial = checkUpstreamPartial(getEnv("CACHE_UPSTREAM_PARTIAL", "reassemble"))
+}
+
+func checkUpstreamPartial(policy string) string {
+	switch policy {
+	case "reassemble", "refuse":
+		return policy
+	}
+	invalidConfig("invalid value for CACHE_UPSTREAM_PARTIAL: %s", policy)
+	return ""
+}
+
+// parseContentRange parses "bytes start-end/total". An unknown total is -1.
+func parseContentRange(value string) (start int64, end int64, total int64, ok bool) {
+	rest, ok := strings.CutPrefix(value, "bytes ")
+	if !ok {
+		return 0, 0, 0, false
+	}
+	span, size, ok := strings.Cut(rest, "/")
+	if !ok {
+		return 0, 0, 0, false
+	}
+	first, last, ok := strings.Cut(span, "-")
+	if !ok {
+		return 0, 0, 0, false
+	}
+
+	var err1, err2, err3 error
+	start, err1 = strconv.ParseInt(first, 10, 64)
+	end, err2 = strconv.ParseInt(last, 10, 64)
+	total = -1
+	if size != "*" {
+		total, err3 = strconv.ParseInt(size, 10, 64)
+	}
+	if err1 != nil || err2 != nil || err3 != nil || start > end {
+		return 0, 0, 0, false
+	}
+	return start, end, total, true
+}
+
+// rangeBody reads a whole object from consecutive range responses.
+type rangeBody struct {
+	url     string
+	current io.ReadCloser
+	offset  int64
+	end     int64
+	total   int64
+	ranges  int
+}
+
+func (b *rangeBody) Read(p []byte) (int, error) {
+	for {
+		n, err := b.current.Read(p)
+		b.offset += int64(n)
+		if err != io.EOF || b.offset >= b.total {
+			return n, err
+		}
+		if b.offset != b.end+1 {
+			return n, ErrTruncated
+		}
+		if n > 0 {
+			return n, nil
+		}
+
+		err = b.next()
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// next requests the rest of the object from where we are. The answer may
+// start earlier, but not later, since that would leave a gap.
+func (b *rangeBody) next() error {
+	b.current.Close()
+	b.current = http.NoBody
+
+	req, err := http.NewRequest(http.MethodGet, b.url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", "bytes="+strconv.FormatInt(b.offset, 10)+"-")
+
+	resp, err := upstreamDo(req)
+	if err != nil {
+		return err
+	}
+	b.current = resp.Body
+
+	start, end, total, ok := parseContentRange(resp.Header.Get("Content-Range"))
+	if resp.StatusCode != http.StatusPartialContent || !ok || start > b.offset || end < b.offset || total != b.total {
+		return ErrPartial
+	}
+	// Origins that align ranges to blocks repeat some of what we have
+	if start < b.offset {
+		_, err = io.CopyN(io.Discard, resp.Body, b.offset-start)
+		if err != nil {
+			return ErrTruncated
+		}
+	}
+	b.end = end
+	b.ranges++
+	return nil
+}
+
+func (b *rangeBody) Close() error {
+	return b.current.Close()
+}
+
+// wholeResponse turns a 206 answer to a full GET into a 200 for the whole
+// object, reading the rest with range requests as the body is read. It
+// fails if the policy is to refuse, or if the response doesn't start at the
+// beginning of an object of known size.
+func wholeResponse(url string, resp *http.Response) (*http.Response, *rangeBody, error) {
+	if upstreamPartial != "reassemble" {
+		return nil, nil, ErrPartial
+	}
+
+	start, end, total, ok := parseContentRange(resp.Header.Get("Content-Range"))
+	if !ok || start != 0 || total < 0 {
+		return nil, nil, ErrPartial
+	}
+
+	body := &rangeBody{url: url, current: resp.Body, end: end, total: total, ranges: 1}
+	whole := *resp
+	whole.Status = "200 OK"
+	whole.StatusCode = http.StatusOK
+	whole.ContentLength = total
+	whole.Header = resp.Header.Clone()
+	whole.Header.Del("Content-Range")
+	whole.Header.Set("Content-Length", strconv.FormatInt(total, 10))
+	whole.Body = body
+	return &whole, body, nil
+}
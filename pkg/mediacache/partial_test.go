@@ -0,0 +1,90 @@
+package mediacache
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// span is a range response: the bytes from start to end of the object,
+// or only the first sent of them if sent is set.
+type span struct {
+	start, end int64
+	total      int64
+	sent       int64
+}
+
+func (s span) respond(w http.ResponseWriter, data string) {
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", s.start, s.end, s.total))
+	w.WriteHeader(http.StatusPartialContent)
+	body := data[s.start : s.end+1]
+	if s.sent > 0 {
+		body = body[:s.sent]
+	}
+	io.WriteString(w, body)
+}
+
+func TestWholeResponse(t *testing.T) {
+	data := strings.Repeat("0123456789", 3)
+
+	tests := []struct {
+		name    string
+		first   string
+		spans   []span
+		ranges  int
+		wantErr error
+	}{
+		{"in order", "bytes 0-9/30", []span{{10, 19, 30, 0}, {20, 29, 30, 0}}, 3, nil},
+		{"in one go", "bytes 0-9/30", []span{{10, 29, 30, 0}}, 2, nil},
+		{"overlapping", "bytes 0-9/30", []span{{5, 19, 30, 0}, {15, 29, 30, 0}}, 3, nil},
+		{"starting over", "bytes 0-9/30", []span{{0, 29, 30, 0}}, 2, nil},
+		{"out of order", "bytes 0-9/30", []span{{20, 29, 30, 0}}, 0, ErrPartial},
+		{"ending before", "bytes 0-9/30", []span{{0, 5, 30, 0}}, 0, ErrPartial},
+		{"other total", "bytes 0-9/30", []span{{10, 29, 40, 0}}, 0, ErrPartial},
+		{"cut short", "bytes 0-9/30", []span{{10, 19, 30, 5}}, 0, ErrTruncated},
+		{"not a range", "bytes 0-9/30", nil, 0, ErrPartial},
+		{"not from the start", "bytes 10-19/30", nil, 0, ErrPartial},
+		{"unknown total", "bytes 0-9/*", nil, 0, ErrPartial},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests := 0
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if requests >= len(tt.spans) {
+					io.WriteString(w, data)
+					return
+				}
+				tt.spans[requests].respond(w, data)
+				requests++
+			}))
+			defer upstream.Close()
+
+			start, end, _, _ := parseContentRange(tt.first)
+			resp := &http.Response{
+				StatusCode: http.StatusPartialContent,
+				Header:     http.Header{"Content-Range": {tt.first}},
+				Body:       io.NopCloser(strings.NewReader(data[start : end+1])),
+			}
+
+			whole, body, err := wholeResponse(upstream.URL, resp)
+			if err == nil {
+				var got []byte
+				got, err = io.ReadAll(whole.Body)
+				whole.Body.Close()
+				if err == nil && string(got) != data {
+					t.Errorf("body = %q, want %q", got, data)
+				}
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && body.ranges != tt.ranges {
+				t.Errorf("ranges = %d, want %d", body.ranges, tt.ranges)
+			}
+		})
+	}
+}
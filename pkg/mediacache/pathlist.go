@@ -0,0 +1,396 @@
+package mediacache
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// pathList is a set of request paths kept in a file, one per line. An
+// entry ending in "*" matches everything starting with it. The blocklist
+// and the pin list are both pathLists.
+type pathList struct {
+	name string
+	file string
+
+	mu      sync.RWMutex
+	entries map[string]bool
+}
+
+func newPathList(name string, file string) *pathList {
+	return &pathList{name: name, file: file, entries: make(map[string]bool)}
+}
+
+func (l *pathList) Load() error {
+	if l.file == "" {
+		return nil
+	}
+
+	file, err := os.Open(l.file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	entries := make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		entry := strings.TrimSpace(scanner.Text())
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		entries[entry] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	l.entries = entries
+	l.mu.Unlock()
+
+	logger.Printf("loaded %d %s entries", len(entries), l.name)
+	return nil
+}
+
+func (l *pathList) Save() error {
+	if l.file == "" {
+		return nil
+	}
+
+	var sb strings.Builder
+	for _, entry := range l.Entries() {
+		sb.WriteString(entry)
+		sb.WriteByte('\n')
+	}
+
+	tmp := l.file + ".tmp"
+	err := os.WriteFile(tmp, []byte(sb.String()), 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, l.file)
+}
+
+func (l *pathList) Entries() []string {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	entries := make([]string, 0, len(l.entries))
+	for entry := range l.entries {
+		entries = append(entries, entry)
+	}
+	sort.Strings(entries)
+	return entries
+}
+
+func (l *pathList) Add(paths ...string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, path := range paths {
+		l.entries[path] = true
+	}
+}
+
+func (l *pathList) Delete(paths ...string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, path := range paths {
+		delete(l.entries, path)
+	}
+}
+
+func (l *pathList) Replace(paths []string) {
+	entries := make(map[string]bool, len(paths))
+	for _, path := range paths {
+		entries[path] = true
+	}
+
+	l.mu.Lock()
+	l.entries = entries
+	l.mu.Unlock()
+}
+
+func (l *pathList) Matches(filename string) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if len(l.entries) == 0 {
+		return false
+	}
+	if l.entries[filename] {
+		return true
+	}
+	for entry := range l.entries {
+		if prefix, ok := strings.CutSuffix(entry, "*"); ok && strings.HasPrefix(filename, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleAdmin lists entries on GET, adds the path parameters on POST and
+// removes them on DELETE. added is called with newly added paths.
+func (l *pathList) handleAdmin(added func(paths []string)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		paths := r.URL.Query()["path"]
+
+		switch r.Method {
+		case http.MethodGet:
+			sendJSON(w, l.Entries())
+			return
+		case http.MethodPost:
+			l.Add(paths...)
+			if added != nil {
+				added(paths)
+			}
+		case http.MethodDelete:
+			l.Delete(paths...)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		err := l.Save()
+		if err != nil {
+			logger.Printf("error saving %s: %v", l.name, err)
+			http.Error(w, "error saving "+l.name, http.StatusInternalServerError)
+			return
+		}
+
+		sendJSON(w, l.Entries())
+	}
+}
+
+// Lists can be exported and imported as a JSON array of paths, or as CSV
+// with a single path column.
+
+func (l *pathList) Export(w io.Writer, format string) error {
+	entries := l.Entries()
+	switch format {
+	case "json":
+		return json.NewEncoder(w).Encode(entries)
+	case "csv":
+		writer := csv.NewWriter(w)
+		_ = writer.Write([]string{"path"})
+		for _, entry := range entries {
+			_ = writer.Write([]string{entry})
+		}
+		writer.Flush()
+		return writer.Error()
+	}
+	return fmt.Errorf("unknown format %s", format)
+}
+
+func decodePaths(r io.Reader, format string) ([]string, error) {
+	switch format {
+	case "json":
+		var paths []string
+		err := json.NewDecoder(r).Decode(&paths)
+		return paths, err
+	case "csv":
+		records, err := csv.NewReader(r).ReadAll()
+		if err != nil {
+			return nil, err
+		}
+		var paths []string
+		for i, record := range records {
+			if len(record) == 0 || (i == 0 && record[0] == "path") {
+				continue
+			}
+			if path := strings.TrimSpace(record[0]); path != "" {
+				paths = append(paths, path)
+			}
+		}
+		return paths, nil
+	}
+	return nil, fmt.Errorf("unknown format %s", format)
+}
+
+// ImportResult describes what an import changed, or would change in a dry
+// run. Affected counts the cached objects matched by added entries.
+type ImportResult struct {
+	Added    int  `json:"added"`
+	Removed  int  `json:"removed"`
+	Total    int  `json:"total"`
+	Affected int  `json:"affected"`
+	DryRun   bool `json:"dryRun"`
+}
+
+// Import merges the paths in r into the list, or replaces it entirely.
+func (l *pathList) Import(r io.Reader, format string, replace bool, dryRun bool) (result ImportResult, added []string, err error) {
+	paths, err := decodePaths(r, format)
+	if err != nil {
+		return result, nil, err
+	}
+
+	current := make(map[string]bool)
+	for _, entry := range l.Entries() {
+		current[entry] = true
+	}
+	incoming := make(map[string]bool, len(paths))
+	for _, path := range paths {
+		if !incoming[path] && !current[path] {
+			added = append(added, path)
+		}
+		incoming[path] = true
+	}
+
+	result.Added = len(added)
+	result.Total = len(current) + len(added)
+	if replace {
+		for entry := range current {
+			if !incoming[entry] {
+				result.Removed++
+			}
+		}
+		result.Total = len(incoming)
+	}
+	result.Affected = countCached(added)
+	result.DryRun = dryRun
+
+	if dryRun {
+		return result, added, nil
+	}
+	if replace {
+		l.Replace(paths)
+	} else {
+		l.Add(added...)
+	}
+	return result, added, l.Save()
+}
+
+// countCached counts the indexed objects whose keys match any of entries.
+func countCached(entries []string) int {
+	if len(entries) == 0 {
+		return 0
+	}
+	matcher := newPathList("", "")
+	matcher.Add(entries...)
+
+	snapshot, _ := index.Snapshot()
+	count := 0
+	for _, entry := range snapshot {
+		if entry.Key != "" && matcher.Matches(entry.Key) {
+			count++
+		}
+	}
+	return count
+}
+
+// handleExport and handleImport expose Export and Import through the admin
+// API; format, replace and dry_run are query parameters.
+func (l *pathList) handleExport(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "json"
+	}
+	switch format {
+	case "json":
+		w.Header().Set("Content-Type", "application/json")
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+	default:
+		http.Error(w, "unknown format", http.StatusBadRequest)
+		return
+	}
+
+	err := l.Export(w, format)
+	if err != nil {
+		logger.Printf("error exporting %s: %v", l.name, err)
+	}
+}
+
+func (l *pathList) handleImport(added func(paths []string)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		query := r.URL.Query()
+		format := query.Get("format")
+		if format == "" {
+			format = "json"
+		}
+
+		result, paths, err := l.Import(io.LimitReader(r.Body, 16<<20), format, query.Has("replace"), query.Has("dry_run"))
+		if err != nil {
+			logger.Printf("error importing %s: %v", l.name, err)
+			http.Error(w, "error importing "+l.name, http.StatusBadRequest)
+			return
+		}
+		if !result.DryRun && added != nil {
+			added(paths)
+		}
+
+		sendJSON(w, result)
+	}
+}
+
+// lists are the path lists that can be exported and imported by name.
+func lists() map[string]*pathList {
+	return map[string]*pathList{
+		"blocklist": blocklist,
+		"pins":      pins,
+	}
+}
+
+// ExportList writes the named list ("blocklist" or "pins") in the given
+// format, json or csv.
+func ExportList(name string, format string, w io.Writer) error {
+	err := configure(Config{})
+	if err != nil {
+		return err
+	}
+	list, ok := lists()[name]
+	if !ok {
+		return fmt.Errorf("unknown list %s", name)
+	}
+	err = list.Load()
+	if err != nil {
+		return err
+	}
+	return list.Export(w, format)
+}
+
+// ImportList imports into the named list's file, see pathList.Import. The
+// affected count comes from the keys in the metadata of the cached objects,
+// see cacheIndex.Scan.
+func ImportList(name string, format string, r io.Reader, replace bool, dryRun bool) (ImportResult, error) {
+	err := configure(Config{})
+	if err != nil {
+		return ImportResult{}, err
+	}
+	list, ok := lists()[name]
+	if !ok {
+		return ImportResult{}, fmt.Errorf("unknown list %s", name)
+	}
+	if list.file == "" {
+		return ImportResult{}, fmt.Errorf("no file configured for %s", name)
+	}
+	err = list.Load()
+	if err != nil {
+		return ImportResult{}, err
+	}
+	err = index.Scan()
+	if err != nil {
+		return ImportResult{}, err
+	}
+	result, _, err := list.Import(r, format, replace, dryRun)
+	return result, err
+}
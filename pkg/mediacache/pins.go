@@ -0,0 +1,20 @@
+package mediacache
+
+var pinlistFile string
+
+// Pinned paths are never evicted, whatever their age or score. They are
+// still revalidated like everything else.
+var pins *pathList
+
+func configurePins() {
+	pinlistFile = getEnv("CACHE_PINLIST_FILE", "")
+	pins = newPathList("pin list", pinlistFile)
+}
+
+func loadPins() error {
+	return pins.Load()
+}
+
+func isPinned(key string) bool {
+	return key != "" && pins.Matches(key)
+}
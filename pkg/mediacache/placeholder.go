@@ -0,0 +1,106 @@
+package mediacache
+
+import (
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Placeholders are images served instead of plain-text errors for missing
+// or blocked media, so timelines render something sensible. Each content
+// class (avatar, emoji, attachment, ...) can have its own image:
+//
+//	CACHE_PLACEHOLDERS="avatar=/srv/avatar.png emoji=/srv/emoji.png"
+//	CACHE_PLACEHOLDER_CLASSES="/avatars=avatar /emoji=emoji"
+//
+// Paths that don't match a class prefix are attachments.
+const defaultContentClass = "attachment"
+
+type placeholder struct {
+	contentType string
+	data        []byte
+}
+
+type classPrefix struct {
+	prefix string
+	class  string
+}
+
+var (
+	placeholders     map[string]placeholder
+	placeholderClass []classPrefix
+)
+
+func configurePlaceholders() {
+	placeholders = loadPlaceholders(getEnv("CACHE_PLACEHOLDERS", ""))
+	placeholderClass = parseClassPrefixes(getEnv("CACHE_PLACEHOLDER_CLASSES", ""))
+}
+
+func loadPlaceholders(value string) map[string]placeholder {
+	result := make(map[string]placeholder)
+	for _, entry := range strings.Fields(value) {
+		class, file, ok := strings.Cut(entry, "=")
+		if !ok {
+			invalidConfig("invalid value for CACHE_PLACEHOLDERS: %s", entry)
+			continue
+		}
+
+		data, err := os.ReadFile(file)
+		if err != nil {
+			invalidConfig("error reading placeholder for %s: %v", class, err)
+			continue
+		}
+
+		contentType := mime.TypeByExtension(filepath.Ext(file))
+		if contentType == "" {
+			contentType = http.DetectContentType(data)
+		}
+
+		result[class] = placeholder{contentType: contentType, data: data}
+	}
+	return result
+}
+
+func parseClassPrefixes(value string) (prefixes []classPrefix) {
+	for _, entry := range strings.Fields(value) {
+		prefix, class, ok := strings.Cut(entry, "=")
+		if !ok {
+			invalidConfig("invalid value for CACHE_PLACEHOLDER_CLASSES: %s", entry)
+			continue
+		}
+		prefixes = append(prefixes, classPrefix{prefix: prefix, class: class})
+	}
+	return prefixes
+}
+
+// contentClass guesses what kind of media a path refers to.
+func contentClass(filename string) string {
+	class := defaultContentClass
+	longest := -1
+	for _, cp := range placeholderClass {
+		if strings.HasPrefix(filename, cp.prefix) && len(cp.prefix) > longest {
+			class = cp.class
+			longest = len(cp.prefix)
+		}
+	}
+	return class
+}
+
+// sendPlaceholder replies with the placeholder image for filename's content
+// class, keeping the error status. It reports false if there is none.
+func sendPlaceholder(w http.ResponseWriter, filename string, status int) (int64, bool) {
+	p, ok := placeholders[contentClass(filename)]
+	if !ok {
+		return 0, false
+	}
+
+	w.Header().Set("Content-Type", p.contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(p.data)))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	n, _ := w.Write(p.data)
+	return int64(n), true
+}
@@ -0,0 +1,153 @@
+package mediacache
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Objects can be fetched ahead of time, either listed in a manifest read
+// at startup or through the admin API, so a fresh node doesn't send a storm
+// of misses to the upstreams. Paths are given the way they appear in URLs,
+// one per line.
+var (
+	warmManifest        string
+	prefetchConcurrency int64
+
+	prefetchSlots chan struct{}
+)
+
+func configurePrefetch() {
+	warmManifest = getEnv("CACHE_WARM_MANIFEST", "")
+	prefetchConcurrency = getEnv[int64]("CACHE_PREFETCH_CONCURRENCY", 4)
+	prefetchSlots = make(chan struct{}, max(prefetchConcurrency, 1))
+}
+
+// prefetchObject caches path unless it is cached already.
+func prefetchObject(path string) error {
+	filename := keyPolicy.ForPath(path)
+	if isBlocked(filename) {
+		return nil
+	}
+
+	lock := getLock(filename)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if checkExists(filename) {
+		return nil
+	}
+	_, source := splitHostKey(path)
+	_, err := fetchFile(context.Background(), filename, source)
+	return err
+}
+
+// prefetch fetches paths in the background, at most prefetchConcurrency at
+// a time. The returned WaitGroup is done once all of them are.
+func prefetch(paths []string) *sync.WaitGroup {
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+		for _, path := range paths {
+			prefetchSlots <- struct{}{}
+			wg.Add(1)
+			go func(path string) {
+				defer wg.Done()
+				defer func() { <-prefetchSlots }()
+
+				err := prefetchObject(path)
+				if err != nil {
+					logger.Printf("error prefetching %s: %v", path, err)
+				}
+			}(path)
+		}
+	}()
+
+	return &wg
+}
+
+// readPaths reads one path per line, skipping blank lines and comments.
+func readPaths(r io.Reader) ([]string, error) {
+	var paths []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		path := strings.TrimSpace(scanner.Text())
+		if path == "" || strings.HasPrefix(path, "#") {
+			continue
+		}
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+		paths = append(paths, path)
+	}
+	return paths, scanner.Err()
+}
+
+// warmCache prefetches everything in the warm manifest, then replays the
+// miss journal. A manifest that can't be read doesn't stop the replay.
+func warmCache() {
+	var paths []string
+	if warmManifest != "" {
+		paths = readWarmManifest()
+	}
+	paths = append(paths, missJournal.replay...)
+	if len(paths) == 0 {
+		return
+	}
+
+	started := time.Now()
+	logger.Printf("warming cache with %d objects", len(paths))
+	prefetch(paths).Wait()
+	logger.Printf("cache warmed in %s", time.Since(started).Round(time.Millisecond))
+}
+
+// readWarmManifest reads the paths in the warm manifest, or as many as it
+// can, logging any error.
+func readWarmManifest() []string {
+	file, err := os.Open(warmManifest)
+	if err != nil {
+		logger.Printf("error opening warm manifest: %v", err)
+		return nil
+	}
+	defer file.Close()
+
+	paths, err := readPaths(file)
+	if err != nil {
+		logger.Printf("error reading warm manifest: %v", err)
+	}
+	return paths
+}
+
+// postAdminPrefetch queues the paths given as path parameters and in the
+// request body, one per line.
+func postAdminPrefetch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	paths := r.URL.Query()["path"]
+	body, err := readPaths(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, "error reading body", http.StatusBadRequest)
+		return
+	}
+	paths = append(paths, body...)
+	if len(paths) == 0 {
+		http.Error(w, "missing path", http.StatusBadRequest)
+		return
+	}
+
+	prefetch(paths)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	sendJSON(w, map[string]int{"queued": len(paths)})
+}
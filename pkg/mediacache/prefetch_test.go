@@ -0,0 +1,22 @@
+package mediacache
+
+import (
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestWarmCacheReplaysWithoutManifest(t *testing.T) {
+	savedManifest, savedReplay := warmManifest, missJournal.replay
+	defer func() { warmManifest, missJournal.replay = savedManifest, savedReplay }()
+
+	target := "/journal-" + strconv.FormatInt(time.Now().UnixNano(), 36) + ".png"
+	warmManifest = filepath.Join(t.TempDir(), "missing")
+	missJournal.replay = []string{target}
+
+	warmCache()
+	if !checkExists(target) {
+		t.Errorf("%s not prefetched from the miss journal", target)
+	}
+}
@@ -0,0 +1,213 @@
+package mediacache
+
+import (
+	"context"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// When all CACHE_MAX_CONCURRENT_FETCHES slots are busy, misses wait up to
+// CACHE_FETCH_QUEUE_TIMEOUT for one, and freed slots go to the highest
+// priority waiting: images first, so avatars and emoji keep loading while
+// videos fill, then everything else, then audio and video. The class comes
+// from the route's priority option, else the file extension, else the
+// Accept header. Without a queue timeout misses are rejected right away,
+// whatever their priority.
+var fetchQueueTimeout time.Duration
+
+func configurePriority() {
+	fetchQueueTimeout = getDuration("CACHE_FETCH_QUEUE_TIMEOUT", "CACHE_FETCH_QUEUE_TIMEOUT_SECONDS", time.Second, 0)
+}
+
+const (
+	priorityHigh = iota
+	priorityNormal
+	priorityLow
+	priorities
+)
+
+var priorityNames = [priorities]string{"high", "normal", "low"}
+
+func parsePriority(name string) (int, bool) {
+	for priority, n := range priorityNames {
+		if n == name {
+			return priority, true
+		}
+	}
+	return 0, false
+}
+
+// mediaPriority gives the priority of a media type, if it has one.
+func mediaPriority(mediaType string) (int, bool) {
+	switch {
+	case strings.HasPrefix(mediaType, "image/"):
+		return priorityHigh, true
+	case strings.HasPrefix(mediaType, "video/"), strings.HasPrefix(mediaType, "audio/"):
+		return priorityLow, true
+	}
+	return priorityNormal, false
+}
+
+// fetchPriority decides how urgent a miss for r is.
+func fetchPriority(r *http.Request) int {
+	if rt := routeFor(r.Host, r.URL.Path); rt.priority >= 0 {
+		return rt.priority
+	}
+	if priority, ok := mediaPriority(mime.TypeByExtension(strings.ToLower(path.Ext(r.URL.Path)))); ok {
+		return priority
+	}
+	// Only the preferred type counts, browsers add */* to everything
+	accept, _, _ := strings.Cut(r.Header.Get("Accept"), ",")
+	mediaType, _, _ := mime.ParseMediaType(accept)
+	priority, _ := mediaPriority(mediaType)
+	return priority
+}
+
+type priorityStats struct {
+	Fetches  uint64 `json:"fetches"`
+	Queued   uint64 `json:"queued"`
+	Rejected uint64 `json:"rejected"`
+	WaitedMs int64  `json:"waitedMs"`
+}
+
+// fetchScheduler hands out the fetch slots. Waiters are granted a slot by
+// having their channel closed.
+var fetchScheduler struct {
+	mu      sync.Mutex
+	active  int64
+	waiting [priorities][]chan struct{}
+	stats   [priorities]priorityStats
+}
+
+func queuedFetches() int {
+	n := 0
+	for _, queue := range fetchScheduler.waiting {
+		n += len(queue)
+	}
+	return n
+}
+
+// acquireFetch takes one of the upstream fetch slots without waiting, and
+// without jumping the queue. Every successful call has to be paired with
+// releaseFetch.
+func acquireFetch() bool {
+	if maxFetches <= 0 {
+		return true
+	}
+
+	s := &fetchScheduler
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.active >= maxFetches || queuedFetches() > 0 {
+		return false
+	}
+	s.active++
+	return true
+}
+
+// acquireFetchFor takes a fetch slot for a miss of the given priority,
+// queueing for up to CACHE_FETCH_QUEUE_TIMEOUT if there is none.
+func acquireFetchFor(ctx context.Context, priority int) bool {
+	s := &fetchScheduler
+	s.mu.Lock()
+	if maxFetches <= 0 {
+		s.stats[priority].Fetches++
+		s.mu.Unlock()
+		return true
+	}
+	if s.active < maxFetches && queuedFetches() == 0 {
+		s.active++
+		s.stats[priority].Fetches++
+		s.mu.Unlock()
+		return true
+	}
+	if fetchQueueTimeout <= 0 {
+		s.stats[priority].Rejected++
+		s.mu.Unlock()
+		return false
+	}
+
+	granted := make(chan struct{})
+	s.waiting[priority] = append(s.waiting[priority], granted)
+	s.stats[priority].Queued++
+	s.mu.Unlock()
+
+	started := time.Now()
+	timer := time.NewTimer(fetchQueueTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-granted:
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats[priority].WaitedMs += time.Since(started).Milliseconds()
+
+	select {
+	case <-granted:
+		s.stats[priority].Fetches++
+		return true
+	default:
+	}
+	queue := s.waiting[priority]
+	for i, waiter := range queue {
+		if waiter == granted {
+			s.waiting[priority] = append(queue[:i:i], queue[i+1:]...)
+			break
+		}
+	}
+	s.stats[priority].Rejected++
+	return false
+}
+
+// releaseFetch gives the slot to the highest priority waiter, if any.
+func releaseFetch() {
+	if maxFetches <= 0 {
+		return
+	}
+
+	s := &fetchScheduler
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for priority, queue := range s.waiting {
+		if len(queue) > 0 {
+			close(queue[0])
+			s.waiting[priority] = queue[1:]
+			return
+		}
+	}
+	s.active--
+}
+
+func activeFetches() int64 {
+	fetchScheduler.mu.Lock()
+	defer fetchScheduler.mu.Unlock()
+	return fetchScheduler.active
+}
+
+type priorityReport struct {
+	priorityStats
+	Waiting int `json:"waiting"`
+}
+
+// prioritiesReport is the per-priority part of the admin stats.
+func prioritiesReport() map[string]priorityReport {
+	s := &fetchScheduler
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	report := make(map[string]priorityReport, priorities)
+	for priority, name := range priorityNames {
+		report[name] = priorityReport{s.stats[priority], len(s.waiting[priority])}
+	}
+	return report
+}
@@ -0,0 +1,111 @@
+package mediacache
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Every purge gets an ID that shows up in the log and can be looked up
+// through the admin API afterwards. There is no cluster mode yet, so the
+// only node a purge has to reach is this one; the per-node results are kept
+// so that replicas can report into the same record once there are any.
+const maxPurgeRecords = 1000
+
+var nodeName string
+
+func configurePurgeLog() {
+	nodeName = getEnv("CACHE_NODE_NAME", defaultNodeName())
+}
+
+func defaultNodeName() string {
+	name, err := os.Hostname()
+	if err != nil {
+		return "local"
+	}
+	return name
+}
+
+type purgeNode struct {
+	Purged   int       `json:"purged"`
+	Failed   int       `json:"failed"`
+	Finished time.Time `json:"finished"`
+}
+
+type purgeRecord struct {
+	ID        string                `json:"id"`
+	Paths     []string              `json:"paths"`
+	Started   time.Time             `json:"started"`
+	Nodes     map[string]*purgeNode `json:"nodes"`
+	Converged bool                  `json:"converged"`
+}
+
+var (
+	purgeRecords   = make(map[string]*purgeRecord)
+	purgeOrder     []string
+	purgeRecordsMu sync.Mutex
+)
+
+func newID() string {
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// startPurge records a new purge of paths.
+func startPurge(paths []string) *purgeRecord {
+	record := &purgeRecord{
+		ID:      newID(),
+		Paths:   paths,
+		Started: time.Now(),
+		Nodes:   make(map[string]*purgeNode),
+	}
+
+	purgeRecordsMu.Lock()
+	defer purgeRecordsMu.Unlock()
+
+	purgeRecords[record.ID] = record
+	purgeOrder = append(purgeOrder, record.ID)
+	if len(purgeOrder) > maxPurgeRecords {
+		delete(purgeRecords, purgeOrder[0])
+		purgeOrder = purgeOrder[1:]
+	}
+	return record
+}
+
+// finishPurge stores a node's result. The purge has converged once every
+// node has reported.
+func finishPurge(record *purgeRecord, node string, purged int, failed int) {
+	purgeRecordsMu.Lock()
+	defer purgeRecordsMu.Unlock()
+
+	record.Nodes[node] = &purgeNode{
+		Purged:   purged,
+		Failed:   failed,
+		Finished: time.Now(),
+	}
+	record.Converged = len(record.Nodes) >= len(clusterNodes())
+}
+
+// clusterNodes lists the nodes a purge has to reach.
+func clusterNodes() []string {
+	return []string{nodeName}
+}
+
+// getAdminPurge reports the status of a purge by ID.
+func getAdminPurge(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+
+	purgeRecordsMu.Lock()
+	defer purgeRecordsMu.Unlock()
+
+	record, ok := purgeRecords[id]
+	if !ok {
+		http.Error(w, "unknown purge", http.StatusNotFound)
+		return
+	}
+	sendJSON(w, record)
+}
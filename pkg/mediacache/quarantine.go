@@ -0,0 +1,161 @@
+package mediacache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const ErrQuarantined = ErrorStr("upstream response quarantined")
+
+// With CACHE_MIME_QUARANTINE the start of every fetched body is sniffed,
+// and if it turns out to be HTML, an executable or WebAssembly while the
+// upstream declared something else, it is neither cached nor served:
+// clients get a 502 and a copy goes to CACHE_QUARANTINE_DIR (by default
+// quarantine/ in the cache directory), along with a JSON file saying where
+// it came from, for someone to look at. The quarantine is always a local
+// directory, even with CACHE_STORAGE=s3, so it can be looked at on the
+// machine running the cache.
+var (
+	mimeQuarantine bool
+	quarantineDir  string
+)
+
+func configureQuarantine() {
+	mimeQuarantine = getEnv("CACHE_MIME_QUARANTINE", false)
+	quarantineDir = getEnv("CACHE_QUARANTINE_DIR", "")
+}
+
+const sniffLen = 512
+
+// sniffBuffer keeps the first sniffLen bytes written to it.
+type sniffBuffer struct {
+	bytes.Buffer
+}
+
+func (b *sniffBuffer) Write(p []byte) (int, error) {
+	if room := sniffLen - b.Len(); room > 0 {
+		b.Buffer.Write(p[:min(room, len(p))])
+	}
+	return len(p), nil
+}
+
+// riskClass sorts content into the kinds that must not pass for
+// something else. Everything else is "".
+func riskClass(contentType string) string {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case "text/html", "application/xhtml+xml":
+		return "html"
+	case "application/x-msdownload", "application/x-executable", "application/x-mach-binary",
+		"application/x-sharedlib", "application/x-elf", "application/vnd.microsoft.portable-executable":
+		return "executable"
+	case "application/wasm":
+		return "wasm"
+	}
+	return ""
+}
+
+// sniffClass is riskClass for the start of a body. Go's sniffer doesn't
+// know executables, so their magic numbers are checked here.
+func sniffClass(head []byte) string {
+	if isPE(head) {
+		return "executable"
+	}
+	for _, magic := range [][]byte{
+		[]byte("\x7fELF"),
+		{0xfe, 0xed, 0xfa, 0xce}, {0xfe, 0xed, 0xfa, 0xcf},
+		{0xce, 0xfa, 0xed, 0xfe}, {0xcf, 0xfa, 0xed, 0xfe},
+	} {
+		if bytes.HasPrefix(head, magic) {
+			return "executable"
+		}
+	}
+	return riskClass(http.DetectContentType(head))
+}
+
+// isPE tells whether head starts a Windows executable. "MZ" alone is too
+// common to go by, so the PE signature it points to has to be there as
+// well, within what was sniffed.
+func isPE(head []byte) bool {
+	if len(head) < 0x40 || !bytes.HasPrefix(head, []byte("MZ")) {
+		return false
+	}
+	offset := binary.LittleEndian.Uint32(head[0x3c:])
+	return offset <= uint32(len(head)-4) && bytes.Equal(head[offset:offset+4], []byte("PE\x00\x00"))
+}
+
+// checkSniffed quarantines an object whose content is of a dangerous kind
+// it wasn't declared as. Executables declared as application/octet-stream
+// are just downloads and pass.
+func checkSniffed(filename string, url string, resp *http.Response, head []byte) error {
+	if !mimeQuarantine || resp.StatusCode != http.StatusOK {
+		return nil
+	}
+
+	declared := resp.Header.Get("Content-Type")
+	sniffed := sniffClass(head)
+	if sniffed == "" || sniffed == riskClass(declared) {
+		return nil
+	}
+	if mediaType, _, _ := mime.ParseMediaType(declared); sniffed == "executable" && mediaType == "application/octet-stream" {
+		return nil
+	}
+
+	stats.Quarantined++
+	logger.Printf("quarantining %s: declared %q, looks like %s", url, declared, sniffed)
+	err := quarantineObject(filename, map[string]any{
+		"source":   url,
+		"declared": declared,
+		"sniffed":  sniffed,
+		"time":     time.Now().UTC(),
+	})
+	if err != nil {
+		logger.Printf("error quarantining %s: %v", url, err)
+	}
+	return ErrQuarantined
+}
+
+// quarantineObject copies an object out of the cache, with info next to it.
+func quarantineObject(filename string, info map[string]any) error {
+	dir := quarantineDir
+	if dir == "" {
+		dir = filepath.Join(cacheDir, "quarantine")
+	}
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	src, err := storage.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.Create(filepath.Join(dir, filename))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	if err != nil {
+		dst.Close()
+		return err
+	}
+	err = dst.Close()
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, filename+".json"), data, 0644)
+}
@@ -0,0 +1,43 @@
+package mediacache
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// dosHeader is the start of a Windows executable whose PE signature is at
+// offset, or junk if offset is past the end.
+func dosHeader(offset uint32, signature string) []byte {
+	head := make([]byte, 0x100)
+	copy(head, "MZ")
+	binary.LittleEndian.PutUint32(head[0x3c:], offset)
+	if int(offset)+len(signature) <= len(head) {
+		copy(head[offset:], signature)
+	}
+	return head
+}
+
+func TestSniffClass(t *testing.T) {
+	tests := []struct {
+		name string
+		head []byte
+		want string
+	}{
+		{"pe", dosHeader(0x80, "PE\x00\x00"), "executable"},
+		{"mz without pe", dosHeader(0x80, "XX\x00\x00"), ""},
+		{"pe past the sniffed bytes", dosHeader(0x1000, "PE\x00\x00"), ""},
+		{"pe header cut short", dosHeader(0xfe, "PE"), ""},
+		{"mz text", []byte("MZ is how this text starts, nothing more"), ""},
+		{"elf", []byte("\x7fELF\x02\x01\x01"), "executable"},
+		{"html", []byte("<!DOCTYPE html><html>"), "html"},
+		{"wasm", []byte("\x00asm\x01\x00\x00\x00"), "wasm"},
+		{"png", []byte("\x89PNG\r\n\x1a\n"), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sniffClass(tt.head); got != tt.want {
+				t.Errorf("sniffClass() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package mediacache
+
+import (
+	"strings"
+)
+
+// Source hosts can be held to a share of the cache, so a single busy
+// remote instance can't push everything else out. CACHE_HOST_QUOTA applies
+// to every host, CACHE_HOST_QUOTAS sets it for specific ones:
+//
+//	CACHE_HOST_QUOTAS="media.example.social=2GB,files.example.net=500MB"
+//
+// The units are binary, so 2GB is 2048MB.
+// Hosts over their quota give up their own objects first, the same way
+// routes with limits do. Zero means no quota.
+var (
+	hostQuota  byteSize
+	hostQuotas map[string]int64
+)
+
+func configureQuotas() {
+	hostQuota = getEnv[byteSize]("CACHE_HOST_QUOTA", 0)
+	hostQuotas = parseHostQuotas(getEnv("CACHE_HOST_QUOTAS", ""))
+}
+
+func parseHostQuotas(value string) map[string]int64 {
+	quotas := make(map[string]int64)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		host, size, ok := strings.Cut(entry, "=")
+		if !ok {
+			invalidConfig("invalid value for CACHE_HOST_QUOTAS: %s", entry)
+			continue
+		}
+		quota, err := parseSize(strings.TrimSpace(size))
+		if err != nil {
+			invalidConfig("invalid value for CACHE_HOST_QUOTAS: %s: %v", entry, err)
+			continue
+		}
+		quotas[strings.TrimSpace(host)] = quota
+	}
+	return quotas
+}
+
+// quotaFor returns the quota of a source host in bytes, or 0 for none.
+// Objects whose host isn't known yet are never held to one.
+func quotaFor(host string) int64 {
+	if host == "" {
+		return 0
+	}
+	if quota, ok := hostQuotas[host]; ok {
+		return quota
+	}
+	return int64(hostQuota)
+}
@@ -0,0 +1,120 @@
+package mediacache
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Clients get a token bucket each, refilled at CACHE_RATE_LIMIT_PER_MINUTE
+// and holding at most CACHE_RATE_LIMIT_BURST requests. Separately, at most
+// CACHE_MAX_CONCURRENT_FETCHES upstream fetches run at once, so misses can't
+// saturate the upstream link no matter how many clients cause them.
+var (
+	rateLimit  int64
+	rateBurst  int64
+	maxFetches int64
+)
+
+func configureRateLimit() {
+	rateLimit = getEnv[int64]("CACHE_RATE_LIMIT_PER_MINUTE", 0)
+	rateBurst = checkRateBurst(getEnv[int64]("CACHE_RATE_LIMIT_BURST", 20))
+	maxFetches = getEnv[int64]("CACHE_MAX_CONCURRENT_FETCHES", 0)
+}
+
+func checkRateBurst(burst int64) int64 {
+	if burst < 1 {
+		invalidConfig("invalid value for CACHE_RATE_LIMIT_BURST: %d", burst)
+	}
+	return burst
+}
+
+type rateBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+var (
+	rateBuckets   = make(map[string]*rateBucket)
+	rateBucketsMu sync.Mutex
+)
+
+// allowRequest takes a token from the client's bucket. If there is none
+// left, it returns how long until there will be.
+func allowRequest(ip string) (ok bool, retryAfter time.Duration) {
+	if rateLimit <= 0 {
+		return true, 0
+	}
+
+	rateBucketsMu.Lock()
+	defer rateBucketsMu.Unlock()
+
+	now := time.Now()
+	perSecond := float64(rateLimit) / 60
+
+	bucket, found := rateBuckets[ip]
+	if !found {
+		bucket = &rateBucket{tokens: float64(rateBurst), updated: now}
+		rateBuckets[ip] = bucket
+	}
+
+	bucket.tokens = math.Min(float64(rateBurst), bucket.tokens+now.Sub(bucket.updated).Seconds()*perSecond)
+	bucket.updated = now
+
+	if bucket.tokens < 1 {
+		return false, time.Duration((1 - bucket.tokens) / perSecond * float64(time.Second))
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+// pruneRateBuckets forgets clients whose buckets have refilled completely,
+// as they are indistinguishable from new ones.
+func pruneRateBuckets() {
+	if rateLimit <= 0 {
+		return
+	}
+
+	rateBucketsMu.Lock()
+	defer rateBucketsMu.Unlock()
+
+	full := time.Duration(float64(rateBurst) / float64(rateLimit) * float64(time.Minute))
+	for ip, bucket := range rateBuckets {
+		if time.Since(bucket.updated) > full {
+			delete(rateBuckets, ip)
+		}
+	}
+}
+
+// sendTooMany rejects a request with 429.
+func sendTooMany(w http.ResponseWriter, retryAfter time.Duration, message string) {
+	seconds := int64(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+	http.Error(w, message, http.StatusTooManyRequests)
+}
+
+// limitsReport describes the configured limits for the stats endpoint.
+func limitsReport() map[string]int64 {
+	rateBucketsMu.Lock()
+	clients := len(rateBuckets)
+	rateBucketsMu.Unlock()
+
+	return map[string]int64{
+		"ratePerMinute": rateLimit,
+		"burst":         rateBurst,
+		"clients":       int64(clients),
+		"maxFetches":    maxFetches,
+		"activeFetches": activeFetches(),
+
+		"maxIngressBytesPerSecond": maxIngress,
+		"ingressBytesPerSecond":    ingressStats.rate.Load(),
+		"ingressWaiting":           ingressStats.waiting.Load(),
+		"ingressQueued":            int64(ingressStats.queued.Load()),
+		"ingressQueuedMs":          ingressStats.queuedNanos.Load() / int64(time.Millisecond),
+	}
+}
@@ -0,0 +1,449 @@
+package mediacache
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// Images above the pixel or size limits are recompressed once when they
+// are fetched, and downscaled if they have too many pixels, keeping their
+// format. This protects small instances from multi-hundred-MB PNGs. The
+// original can be kept as a variant, served for requests with ?original.
+// Images too large to even decode safely are left alone, and so are images
+// with an EXIF orientation or an ICC profile, which re-encoding would drop,
+// turning photos sideways and shifting their colours.
+var (
+	recompress             bool
+	recompressMaxPixels    int64
+	recompressMaxSize      int64
+	recompressDecodeLimit  int64
+	recompressJpegQuality  int
+	recompressKeepOriginal bool
+)
+
+func configureRecompress() {
+	recompress = getEnv("CACHE_RECOMPRESS", false)
+	recompressMaxPixels = getEnv[int64]("CACHE_RECOMPRESS_MAX_MEGAPIXELS", 16) * 1_000_000
+	recompressMaxSize = getSize("CACHE_RECOMPRESS_MAX_SIZE", "CACHE_RECOMPRESS_MAX_SIZE_MB", 1<<20, 10<<20)
+	recompressDecodeLimit = getEnv[int64]("CACHE_RECOMPRESS_DECODE_LIMIT_MEGAPIXELS", 100) * 1_000_000
+	recompressJpegQuality = int(getEnv[int64]("CACHE_RECOMPRESS_JPEG_QUALITY", 85))
+	recompressKeepOriginal = getEnv("CACHE_RECOMPRESS_KEEP_ORIGINAL", false)
+}
+
+type originalKey struct{}
+
+// originalName is where the original of a recompressed object is kept.
+func originalName(filename string) string {
+	return filename + ".original"
+}
+
+// withOriginal takes the original parameter out of the query, so it is
+// neither part of the cache key nor sent upstream, and remembers it in the
+// request context instead.
+func withOriginal(r *http.Request) *http.Request {
+	if !recompressKeepOriginal {
+		return r
+	}
+
+	query := r.URL.Query()
+	if !query.Has("original") {
+		return r
+	}
+	query.Del("original")
+
+	r = r.WithContext(context.WithValue(r.Context(), originalKey{}, true))
+	r.URL.RawQuery = query.Encode()
+	return r
+}
+
+// wantsOriginal reports whether r asked for the original of an image.
+func wantsOriginal(r *http.Request) bool {
+	return r.Context().Value(originalKey{}) != nil
+}
+
+func imageFormat(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = strings.ToLower(strings.TrimSpace(contentType))
+	}
+	switch mediaType {
+	case "image/jpeg":
+		return "jpeg"
+	case "image/png":
+		return "png"
+	}
+	return ""
+}
+
+// recompressObject shrinks a freshly stored image if it is over the limits.
+// The image is worked on outside the fill gate, and only putting the result
+// and its metadata in place holds back snapshots. Failures leave the object
+// as it was.
+func recompressObject(filename string, meta fileMeta) {
+	if !recompress || imageFormat(meta.ContentType) == "" {
+		return
+	}
+
+	file, err := storage.Open(filename)
+	if err != nil {
+		logger.Printf("recompress %s: %v", filename, err)
+		return
+	}
+	config, format, err := image.DecodeConfig(file)
+	file.Close()
+	if err != nil || format != imageFormat(meta.ContentType) {
+		// Mislabelled or broken, not ours to fix
+		return
+	}
+
+	pixels := int64(config.Width) * int64(config.Height)
+	if pixels <= recompressMaxPixels && meta.Size <= recompressMaxSize {
+		return
+	}
+	if pixels > recompressDecodeLimit {
+		logger.Printf("recompress %s: %dx%d is too large to decode, leaving it", filename, config.Width, config.Height)
+		return
+	}
+
+	file, err = storage.Open(filename)
+	if err != nil {
+		logger.Printf("recompress %s: %v", filename, err)
+		return
+	}
+	needed, err := hasRenderingMetadata(bufio.NewReader(file), format)
+	file.Close()
+	if err != nil {
+		return
+	}
+	if needed {
+		logger.Printf("recompress %s: has an EXIF orientation or ICC profile, leaving it", filename)
+		return
+	}
+
+	data, err := recompressImage(filename, format, pixels)
+	if err != nil {
+		logger.Printf("recompress %s: %v", filename, err)
+		return
+	}
+	if int64(len(data)) >= meta.Size && pixels <= recompressMaxPixels {
+		// Didn't help, keep the original
+		return
+	}
+
+	fillGate.RLock()
+	defer fillGate.RUnlock()
+
+	if recompressKeepOriginal {
+		err = copyObject(filename, originalName(filename), meta)
+		if err != nil {
+			logger.Printf("recompress %s: error keeping original: %v", filename, err)
+			return
+		}
+	}
+
+	err = writeObject(filename, data)
+	if err != nil {
+		logger.Printf("recompress %s: %v", filename, err)
+		return
+	}
+
+	logger.Printf("recompressed %s: %d -> %d bytes", filename, meta.Size, len(data))
+	sum := sha256.Sum256(data)
+	meta.Size = int64(len(data))
+	meta.Checksum = hex.EncodeToString(sum[:])
+	if meta.ETag != "" && !strings.HasPrefix(meta.ETag, "W/") {
+		// Still the same image, but no longer the same bytes
+		meta.ETag = "W/" + meta.ETag
+	}
+
+	err = writeMeta(filename, meta)
+	if err != nil {
+		// The data no longer matches the metadata
+		logger.Printf("recompress %s: %v", filename, err)
+		_ = removeObject(filename)
+		return
+	}
+	index.Add(filename, meta)
+}
+
+func recompressImage(filename string, format string, pixels int64) ([]byte, error) {
+	file, err := storage.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(file)
+	file.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	if pixels > recompressMaxPixels {
+		scale := math.Sqrt(float64(recompressMaxPixels) / float64(pixels))
+		bounds := img.Bounds()
+		img = downscale(img, int(float64(bounds.Dx())*scale), int(float64(bounds.Dy())*scale))
+	}
+
+	var buf bytes.Buffer
+	switch format {
+	case "jpeg":
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: recompressJpegQuality})
+	case "png":
+		encoder := png.Encoder{CompressionLevel: png.BestCompression}
+		err = encoder.Encode(&buf, img)
+	}
+	return buf.Bytes(), err
+}
+
+// hasRenderingMetadata reports whether an image carries an EXIF orientation
+// other than the default or an ICC profile, which the encoders don't keep.
+// Only the headers before the image data are read.
+func hasRenderingMetadata(r *bufio.Reader, format string) (bool, error) {
+	switch format {
+	case "jpeg":
+		return jpegHasRenderingMetadata(r)
+	case "png":
+		return pngHasRenderingMetadata(r)
+	}
+	return false, nil
+}
+
+func jpegHasRenderingMetadata(r *bufio.Reader) (bool, error) {
+	var soi [2]byte
+	_, err := io.ReadFull(r, soi[:])
+	if err != nil {
+		return false, err
+	}
+	if soi != [2]byte{0xff, 0xd8} {
+		return false, errors.New("not a JPEG")
+	}
+
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return false, err
+		}
+		if b != 0xff {
+			return false, errors.New("invalid JPEG marker")
+		}
+		// Markers may be padded with any number of 0xff
+		for b == 0xff {
+			b, err = r.ReadByte()
+			if err != nil {
+				return false, err
+			}
+		}
+
+		switch {
+		case b == 0xda || b == 0xd9:
+			// Start of scan or end of image, no more headers
+			return false, nil
+		case b == 0x01 || (b >= 0xd0 && b <= 0xd7):
+			// No length
+			continue
+		}
+
+		var length [2]byte
+		_, err = io.ReadFull(r, length[:])
+		if err != nil {
+			return false, err
+		}
+		n := int(binary.BigEndian.Uint16(length[:])) - 2
+		if n < 0 {
+			return false, errors.New("invalid JPEG segment length")
+		}
+		if b != 0xe1 && b != 0xe2 {
+			_, err = r.Discard(n)
+			if err != nil {
+				return false, err
+			}
+			continue
+		}
+
+		segment := make([]byte, n)
+		_, err = io.ReadFull(r, segment)
+		if err != nil {
+			return false, err
+		}
+		if b == 0xe2 && bytes.HasPrefix(segment, []byte("ICC_PROFILE\x00")) {
+			return true, nil
+		}
+		if exif, ok := bytes.CutPrefix(segment, []byte("Exif\x00\x00")); ok && b == 0xe1 && exifOrientation(exif) > 1 {
+			return true, nil
+		}
+	}
+}
+
+func pngHasRenderingMetadata(r *bufio.Reader) (bool, error) {
+	var signature [8]byte
+	_, err := io.ReadFull(r, signature[:])
+	if err != nil {
+		return false, err
+	}
+	if string(signature[:]) != "\x89PNG\r\n\x1a\n" {
+		return false, errors.New("not a PNG")
+	}
+
+	for {
+		var header [8]byte
+		_, err = io.ReadFull(r, header[:])
+		if err != nil {
+			return false, err
+		}
+		length := int64(binary.BigEndian.Uint32(header[:4]))
+		if length > math.MaxInt32 {
+			return false, errors.New("invalid PNG chunk length")
+		}
+
+		switch string(header[4:]) {
+		case "IDAT", "IEND":
+			return false, nil
+		case "iCCP":
+			return true, nil
+		case "eXIf":
+			exif := make([]byte, length)
+			_, err = io.ReadFull(r, exif)
+			if err != nil {
+				return false, err
+			}
+			if exifOrientation(exif) > 1 {
+				return true, nil
+			}
+			length = 0
+		}
+
+		// The rest of the chunk and its CRC
+		_, err = r.Discard(int(length) + 4)
+		if err != nil {
+			return false, err
+		}
+	}
+}
+
+// exifOrientation reads the Orientation tag from the first IFD of EXIF
+// data, or returns 0 if it isn't there.
+func exifOrientation(exif []byte) int {
+	if len(exif) < 8 {
+		return 0
+	}
+	var order binary.ByteOrder
+	switch string(exif[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+
+	ifd := int64(order.Uint32(exif[4:]))
+	if ifd+2 > int64(len(exif)) {
+		return 0
+	}
+	entries := int64(order.Uint16(exif[ifd:]))
+	for i := int64(0); i < entries; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > int64(len(exif)) {
+			return 0
+		}
+		if order.Uint16(exif[entry:]) == 0x0112 {
+			return int(order.Uint16(exif[entry+8:]))
+		}
+	}
+	return 0
+}
+
+// downscale resizes src to width x height by averaging the source pixels
+// each destination pixel covers.
+func downscale(src image.Image, width int, height int) image.Image {
+	width, height = max(width, 1), max(height, 1)
+	bounds := src.Bounds()
+	dst := image.NewNRGBA(image.Rect(0, 0, width, height))
+
+	for y := 0; y < height; y++ {
+		y0 := bounds.Min.Y + y*bounds.Dy()/height
+		y1 := max(bounds.Min.Y+(y+1)*bounds.Dy()/height, y0+1)
+		for x := 0; x < width; x++ {
+			x0 := bounds.Min.X + x*bounds.Dx()/width
+			x1 := max(bounds.Min.X+(x+1)*bounds.Dx()/width, x0+1)
+
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, b, a = r+uint64(cr), g+uint64(cg), b+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+
+			// Averaged premultiplied, stored non-premultiplied
+			i := dst.PixOffset(x, y)
+			if a == 0 {
+				continue
+			}
+			dst.Pix[i+0] = uint8(r * 0xff / a)
+			dst.Pix[i+1] = uint8(g * 0xff / a)
+			dst.Pix[i+2] = uint8(b * 0xff / a)
+			dst.Pix[i+3] = uint8(a / n >> 8)
+		}
+	}
+	return dst
+}
+
+// copyObject stores a copy of an object and its metadata under a new name.
+func copyObject(from string, to string, meta fileMeta) error {
+	src, err := storage.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := storage.Create(to)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	if err != nil {
+		dst.Abort()
+		return err
+	}
+	err = dst.Close()
+	if err != nil {
+		_ = storage.Remove(to)
+		return err
+	}
+
+	err = writeMeta(to, meta)
+	if err != nil {
+		_ = storage.Remove(to)
+		return err
+	}
+	index.Add(to, meta)
+	return nil
+}
+
+// writeObject replaces an object's data.
+func writeObject(name string, data []byte) error {
+	file, err := storage.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err != nil {
+		file.Abort()
+		return err
+	}
+	return file.Close()
+}
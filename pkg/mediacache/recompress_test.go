@@ -0,0 +1,120 @@
+package mediacache
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+// exif is EXIF data with the given orientation in its first IFD, or none
+// if orientation is zero.
+func exif(order binary.ByteOrder, orientation uint16) []byte {
+	var b bytes.Buffer
+	if order == binary.LittleEndian {
+		b.WriteString("II")
+	} else {
+		b.WriteString("MM")
+	}
+	binary.Write(&b, order, uint16(42))
+	binary.Write(&b, order, uint32(8))
+	if orientation == 0 {
+		binary.Write(&b, order, uint16(0))
+		return b.Bytes()
+	}
+	binary.Write(&b, order, uint16(2))
+	// Make, so the orientation isn't the first entry
+	binary.Write(&b, order, []uint16{0x010f, 2})
+	binary.Write(&b, order, []uint32{1, 0})
+	binary.Write(&b, order, []uint16{0x0112, 3})
+	binary.Write(&b, order, uint32(1))
+	binary.Write(&b, order, []uint16{orientation, 0})
+	return b.Bytes()
+}
+
+// jpegWith is a small JPEG with the given APPn segments after its SOI.
+func jpegWith(segments ...[]byte) []byte {
+	var img bytes.Buffer
+	jpeg.Encode(&img, image.NewGray(image.Rect(0, 0, 8, 8)), nil)
+
+	var b bytes.Buffer
+	b.Write(img.Bytes()[:2])
+	for _, segment := range segments {
+		b.Write(segment[:2])
+		binary.Write(&b, binary.BigEndian, uint16(len(segment)))
+		b.Write(segment[2:])
+	}
+	b.Write(img.Bytes()[2:])
+	return b.Bytes()
+}
+
+// pngWith is a small PNG with the given chunks after its IHDR.
+func pngWith(chunks ...[]byte) []byte {
+	var img bytes.Buffer
+	png.Encode(&img, image.NewGray(image.Rect(0, 0, 8, 8)))
+
+	// Signature and IHDR
+	headerLen := 8 + 8 + 13 + 4
+	var b bytes.Buffer
+	b.Write(img.Bytes()[:headerLen])
+	for _, chunk := range chunks {
+		binary.Write(&b, binary.BigEndian, uint32(len(chunk)-4))
+		b.Write(chunk)
+		binary.Write(&b, binary.BigEndian, crc32.ChecksumIEEE(chunk))
+	}
+	b.Write(img.Bytes()[headerLen:])
+	return b.Bytes()
+}
+
+func TestHasRenderingMetadata(t *testing.T) {
+	app1 := func(data []byte) []byte { return append([]byte("\xff\xe1Exif\x00\x00"), data...) }
+
+	tests := []struct {
+		name   string
+		format string
+		data   []byte
+		want   bool
+	}{
+		{"plain jpeg", "jpeg", jpegWith(), false},
+		{"jpeg rotated", "jpeg", jpegWith(app1(exif(binary.BigEndian, 6))), true},
+		{"jpeg rotated, little endian", "jpeg", jpegWith(app1(exif(binary.LittleEndian, 8))), true},
+		{"jpeg upright", "jpeg", jpegWith(app1(exif(binary.BigEndian, 1))), false},
+		{"jpeg exif without orientation", "jpeg", jpegWith(app1(exif(binary.BigEndian, 0))), false},
+		{"jpeg icc", "jpeg", jpegWith([]byte("\xff\xe2ICC_PROFILE\x00\x01\x01")), true},
+		{"jpeg other app segment", "jpeg", jpegWith([]byte("\xff\xe2FPXR\x00")), false},
+		{"plain png", "png", pngWith(), false},
+		{"png icc", "png", pngWith([]byte("iCCPsRGB\x00\x00\x78\x9c")), true},
+		{"png rotated", "png", pngWith(append([]byte("eXIf"), exif(binary.BigEndian, 3)...)), true},
+		{"png upright", "png", pngWith(append([]byte("eXIf"), exif(binary.BigEndian, 1)...)), false},
+		{"png other chunk", "png", pngWith([]byte("tEXtComment\x00hi")), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := hasRenderingMetadata(bufio.NewReader(bytes.NewReader(tt.data)), tt.format)
+			if err != nil {
+				t.Fatalf("hasRenderingMetadata() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("hasRenderingMetadata() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHasRenderingMetadataDecodes(t *testing.T) {
+	// The test images have to be valid, or the parser is only agreeing
+	// with itself
+	for _, data := range [][]byte{
+		jpegWith([]byte("\xff\xe1Exif\x00\x00"), []byte("\xff\xe2ICC_PROFILE\x00\x01\x01")),
+		pngWith([]byte("tEXtComment\x00hi")),
+	} {
+		_, _, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Errorf("image.Decode() error = %v", err)
+		}
+	}
+}
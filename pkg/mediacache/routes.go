@@ -0,0 +1,275 @@
+package mediacache
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Routes send path prefixes, optionally on a given Host, to their own
+// upstreams, so one instance can cache several origins:
+//
+//	CACHE_ROUTES="/media/=>https://s3.example.com/media,/proxy/=>https://a.example.com https://b.example.com"
+//	CACHE_ROUTES="static.example.com/=>https://assets.example.com max_size=2GB max_files=100000 admission=second-hit"
+//	CACHE_ROUTES="/video/=>https://videos.example.com priority=low"
+//	CACHE_ROUTES="/private/=>https://a.example.com middleware=ipacl,signature"
+//
+// The upstream URL stands in for the prefix, so /media/a.png is fetched
+// from https://s3.example.com/media/a.png. Prefixes match whole path
+// segments, so /media would not cover /mediafoo/a.png. Routes on a host
+// win over routes on any host, then the longest prefix wins; everything
+// else goes to CACHE_UPSTREAM. Objects behind host routes are keyed as
+// //host/path, so the same path on two hosts doesn't collide; that is also
+// how they are given to the admin API.
+//
+// max_size and max_files cap a route's share of the cache, evicting its
+// own objects first, on top of the global limits; sizes are binary, so
+// max_size=1GB is 1024MB. admission overrides CACHE_ADMISSION, priority
+// (high, normal or low) the priority misses would otherwise get in the
+// fetch queue. middleware replaces the CACHE_MIDDLEWARE chain; the commas
+// between its names don't start a new route, so it has to be the route's
+// last option.
+var cacheRoutes string
+
+type route struct {
+	host      string
+	prefix    string
+	upstreams []*upstreamState
+
+	maxSize    float64
+	maxFiles   int64
+	admission  string
+	priority   int
+	middleware string
+
+	stats Stats
+}
+
+var (
+	defaultRoute *route
+	routes       []*route
+)
+
+func configureRoutes() {
+	cacheRoutes = getEnv("CACHE_ROUTES", "")
+	routes = parseRoutes(cacheRoutes)
+	defaultRoute = &route{upstreams: upstreamStates, admission: admission, priority: -1, middleware: middlewareChain}
+}
+
+// splitRoutes splits CACHE_ROUTES at the commas that start a new route,
+// rather than continue a middleware option.
+func splitRoutes(value string) (entries []string) {
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		switch {
+		case entry == "":
+		case len(entries) > 0 && !strings.Contains(entry, "=>") && endsWithMiddleware(entries[len(entries)-1]):
+			entries[len(entries)-1] += "," + entry
+		default:
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+func endsWithMiddleware(entry string) bool {
+	fields := strings.Fields(entry)
+	return strings.HasPrefix(fields[len(fields)-1], "middleware=")
+}
+
+func parseRoutes(value string) (routes []*route) {
+	for _, entry := range splitRoutes(value) {
+		pattern, targets, ok := strings.Cut(entry, "=>")
+		if !ok {
+			invalidConfig("invalid value for CACHE_ROUTES: %s", entry)
+			continue
+		}
+		pattern = strings.TrimSpace(pattern)
+
+		rt := &route{prefix: pattern, admission: admission, priority: -1, middleware: middlewareChain, stats: Stats{Name: "ROUTE " + pattern}}
+		if !strings.HasPrefix(pattern, "/") {
+			host, prefix, _ := strings.Cut(pattern, "/")
+			rt.host, rt.prefix = host, "/"+prefix
+		}
+
+		var urls []string
+		for _, target := range strings.Fields(targets) {
+			option, value, ok := strings.Cut(target, "=")
+			if !ok || strings.Contains(target, "://") {
+				urls = append(urls, target)
+				continue
+			}
+
+			var err error
+			switch option {
+			case "max_size":
+				var size int64
+				size, err = parseSize(value)
+				rt.maxSize = float64(size) / (1 << 20)
+			case "max_size_mb":
+				logger.Printf("CACHE_ROUTES: max_size_mb is deprecated, use max_size=%sMB instead", value)
+				rt.maxSize, err = strconv.ParseFloat(value, 64)
+			case "max_files":
+				rt.maxFiles, err = strconv.ParseInt(value, 10, 64)
+			case "admission":
+				if value != "all" && value != "second-hit" {
+					invalidConfig("invalid value for CACHE_ROUTES: unknown admission policy %s", value)
+				}
+				rt.admission = value
+			case "priority":
+				var known bool
+				rt.priority, known = parsePriority(value)
+				if !known {
+					invalidConfig("invalid value for CACHE_ROUTES: unknown priority %s", value)
+				}
+			case "middleware":
+				checkChain("CACHE_ROUTES", value)
+				rt.middleware = value
+			default:
+				invalidConfig("invalid value for CACHE_ROUTES: unknown option %s", option)
+			}
+			if err != nil {
+				invalidConfig("invalid value for CACHE_ROUTES: %s: %v", target, err)
+			}
+		}
+		if len(urls) == 0 {
+			invalidConfig("invalid value for CACHE_ROUTES: no upstream for %s", pattern)
+			continue
+		}
+		rt.upstreams = newUpstreamStates(urls)
+
+		routes = append(routes, rt)
+	}
+	return routes
+}
+
+// routeFor picks the route for a request to path on host.
+func routeFor(host string, path string) *route {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	selected := defaultRoute
+	for _, rt := range routes {
+		if (rt.host != "" && rt.host != host) || !hasPathPrefix(path, rt.prefix) {
+			continue
+		}
+		switch {
+		case rt.host != "" && selected.host == "":
+			selected = rt
+		case rt.host == "" && selected.host != "":
+		case len(rt.prefix) > len(selected.prefix):
+			selected = rt
+		}
+	}
+	return selected
+}
+
+// hasPathPrefix reports whether path is under prefix, taking whole path
+// segments only: /media covers /media and /media/a.png, but not
+// /mediafoo/a.png. path may carry a query, as keys do.
+func hasPathPrefix(path string, prefix string) bool {
+	rest, ok := strings.CutPrefix(path, prefix)
+	if !ok {
+		return false
+	}
+	return rest == "" || strings.HasSuffix(prefix, "/") || rest[0] == '/' || rest[0] == '?'
+}
+
+// splitHostKey splits a //host/path key into its parts. Other keys have
+// no host.
+func splitHostKey(key string) (host string, path string) {
+	rest, ok := strings.CutPrefix(key, "//")
+	if !ok {
+		return "", key
+	}
+	host, path, _ = strings.Cut(rest, "/")
+	return host, "/" + path
+}
+
+// routeForKey finds the route an object was fetched through.
+func routeForKey(key string) *route {
+	return routeFor(splitHostKey(key))
+}
+
+// key turns a request's cache key into the key the object is stored under.
+func (rt *route) key(key string) string {
+	if rt.host == "" {
+		return key
+	}
+	return "//" + rt.host + key
+}
+
+// url returns the upstream URL for source, the path and query as the
+// client sent them.
+func (rt *route) url(upstream *upstreamState, source string) string {
+	if rt.prefix != "" {
+		source = strings.TrimPrefix(source, strings.TrimSuffix(rt.prefix, "/"))
+	}
+	return joinUrl(upstream.url, source)
+}
+
+// allUpstreams returns the upstreams of every route.
+func allUpstreams() []*upstreamState {
+	all := append([]*upstreamState(nil), defaultRoute.upstreams...)
+	for _, rt := range routes {
+		all = append(all, rt.upstreams...)
+	}
+	return all
+}
+
+// withRouteStats counts requests per route, by the result next reports in
+// X-Cache.
+func withRouteStats(next http.HandlerFunc) http.HandlerFunc {
+	if len(routes) == 0 {
+		return next
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		rt := routeFor(r.Host, r.URL.Path)
+		lw := &loggingWriter{ResponseWriter: w}
+		next(lw, r)
+
+		s := &rt.stats
+		s.Requests++
+		s.Completed++
+		s.SentBytes += uint64(lw.bytes)
+		switch cacheResult(lw.Header().Get("X-Cache"), lw.status) {
+		case "HIT", "MEM-HIT", "DISK-HIT", "STALE":
+			s.Hits++
+			s.HitBytes += uint64(lw.bytes)
+		case "MISS", "PASS", "BYPASS":
+			s.Misses++
+			s.MissBytes += uint64(lw.bytes)
+		case "ERROR":
+			s.Errors++
+		}
+	}
+}
+
+func reportRoutes() {
+	if !printStats {
+		return
+	}
+	for _, rt := range routes {
+		rt.stats.Report()
+	}
+}
+
+// routesReport is the per-route part of the admin stats.
+func routesReport() map[string]*Stats {
+	report := make(map[string]*Stats, len(routes))
+	for _, rt := range routes {
+		report[strings.TrimPrefix(rt.stats.Name, "ROUTE ")] = &rt.stats
+	}
+	return report
+}
+
+func upstreamURLs(states []*upstreamState) string {
+	urls := make([]string, len(states))
+	for i, u := range states {
+		urls[i] = u.url
+	}
+	return strings.Join(urls, ", ")
+}
@@ -0,0 +1,50 @@
+package mediacache
+
+import "testing"
+
+func TestRouteFor(t *testing.T) {
+	saved, savedDefault := routes, defaultRoute
+	defer func() { routes, defaultRoute = saved, savedDefault }()
+
+	routes = parseRoutes("/media=>https://s3.example.com/media," +
+		"/static/=>https://static.example.com," +
+		"/static/big/=>https://big.example.com," +
+		"img.example.com/=>https://img.example.com," +
+		"img.example.com/thumbs=>https://thumbs.example.com")
+	defaultRoute = &route{}
+
+	tests := []struct {
+		host string
+		path string
+		want string
+		url  string
+	}{
+		{"cache.example.com", "/media", "/media", "https://s3.example.com/media/"},
+		{"cache.example.com", "/media/a.png", "/media", "https://s3.example.com/media/a.png"},
+		{"cache.example.com", "/media?w=1", "/media", "https://s3.example.com/media/?w=1"},
+		{"cache.example.com", "/mediafoo/a.png", "", ""},
+		{"cache.example.com", "/static/a.png", "/static/", "https://static.example.com/a.png"},
+		{"cache.example.com", "/static", "", ""},
+		{"cache.example.com", "/static/big/a.png", "/static/big/", "https://big.example.com/a.png"},
+		{"cache.example.com", "/static/bigger/a.png", "/static/", "https://static.example.com/bigger/a.png"},
+		{"img.example.com", "/media/a.png", "img.example.com/", "https://img.example.com/media/a.png"},
+		{"img.example.com:8080", "/a.png", "img.example.com/", "https://img.example.com/a.png"},
+		{"img.example.com", "/thumbs/a.png", "img.example.com/thumbs", "https://thumbs.example.com/a.png"},
+		{"img.example.com", "/thumbsup/a.png", "img.example.com/", "https://img.example.com/thumbsup/a.png"},
+		{"other.example.com", "/thumbs/a.png", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host+tt.path, func(t *testing.T) {
+			rt := routeFor(tt.host, tt.path)
+			if got := rt.host + rt.prefix; got != tt.want {
+				t.Fatalf("routeFor() = %q, want %q", got, tt.want)
+			}
+			if rt == defaultRoute {
+				return
+			}
+			if got := rt.url(rt.upstreams[0], tt.path); got != tt.url {
+				t.Errorf("url() = %q, want %q", got, tt.url)
+			}
+		})
+	}
+}
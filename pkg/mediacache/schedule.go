@@ -0,0 +1,95 @@
+package mediacache
+
+import (
+	"strings"
+	"time"
+)
+
+// maintenanceWindow is a daily period in which heavy maintenance may run,
+// written as "03:00-05:00", optionally followed by "daily" or a comma
+// separated list of weekdays, e.g. "22:00-02:00 sat,sun". Windows may wrap
+// past midnight, in which case the weekday is the one the window starts on.
+type maintenanceWindow struct {
+	start time.Duration
+	end   time.Duration
+	days  map[time.Weekday]bool
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+func parseMaintenanceWindow(value string) *maintenanceWindow {
+	fields := strings.Fields(strings.ToLower(value))
+	if len(fields) == 0 {
+		return nil
+	}
+	if len(fields) > 2 {
+		invalidConfig("invalid value for CACHE_MAINTENANCE_WINDOW: %s", value)
+		return nil
+	}
+
+	startStr, endStr, ok := strings.Cut(fields[0], "-")
+	if !ok {
+		invalidConfig("invalid value for CACHE_MAINTENANCE_WINDOW: %s", value)
+		return nil
+	}
+
+	window := &maintenanceWindow{
+		start: parseClock(startStr, value),
+		end:   parseClock(endStr, value),
+	}
+
+	if len(fields) == 2 && fields[1] != "daily" {
+		window.days = make(map[time.Weekday]bool)
+		for _, day := range strings.Split(fields[1], ",") {
+			weekday, ok := weekdays[day]
+			if !ok {
+				invalidConfig("invalid weekday in CACHE_MAINTENANCE_WINDOW: %s", day)
+				continue
+			}
+			window.days[weekday] = true
+		}
+	}
+
+	return window
+}
+
+func parseClock(clock string, value string) time.Duration {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		invalidConfig("invalid value for CACHE_MAINTENANCE_WINDOW: %s: %v", value, err)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+}
+
+func (mw *maintenanceWindow) contains(t time.Time) bool {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	clock := t.Sub(midnight)
+	day := t.Weekday()
+
+	var inside bool
+	if mw.start <= mw.end {
+		inside = clock >= mw.start && clock < mw.end
+	} else {
+		// Wraps past midnight
+		inside = clock >= mw.start || clock < mw.end
+		if clock < mw.end {
+			day = (day + 6) % 7
+		}
+	}
+
+	return inside && (mw.days == nil || mw.days[day])
+}
+
+// inMaintenanceWindow reports whether heavy maintenance may run now. Without
+// a configured window it always may.
+func inMaintenanceWindow() bool {
+	return maintenance == nil || maintenance.contains(time.Now())
+}
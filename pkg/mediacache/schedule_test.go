@@ -0,0 +1,57 @@
+package mediacache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMaintenanceWindow(t *testing.T) {
+	// 2 January 2026 is a Friday
+	at := func(day int, clock string) time.Time {
+		t, _ := time.Parse("15:04", clock)
+		return time.Date(2026, 1, day, t.Hour(), t.Minute(), 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		name   string
+		window string
+		at     time.Time
+		want   bool
+	}{
+		{"inside", "03:00-05:00", at(2, "04:00"), true},
+		{"at the start", "03:00-05:00", at(2, "03:00"), true},
+		{"at the end", "03:00-05:00", at(2, "05:00"), false},
+		{"before", "03:00-05:00", at(2, "02:59"), false},
+		{"daily", "03:00-05:00 daily", at(3, "04:00"), true},
+		{"wrapping, before midnight", "22:00-02:00", at(2, "23:00"), true},
+		{"wrapping, after midnight", "22:00-02:00", at(3, "01:00"), true},
+		{"wrapping, outside", "22:00-02:00", at(3, "12:00"), false},
+		{"wrapping, at the end", "22:00-02:00", at(3, "02:00"), false},
+		{"weekday", "22:00-02:00 sat,sun", at(3, "23:00"), true},
+		{"other weekday", "22:00-02:00 sat,sun", at(2, "23:00"), false},
+		{"after midnight counts as the day before", "22:00-02:00 sat,sun", at(3, "01:00"), false},
+		{"after midnight into monday", "22:00-02:00 sat,sun", at(5, "01:00"), true},
+		{"after midnight on another day", "22:00-02:00 sat,sun", at(6, "01:00"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mw *maintenanceWindow
+			if !withSettings(t, nil, nil, func() { mw = parseMaintenanceWindow(tt.window) }) {
+				t.Fatalf("parseMaintenanceWindow(%q) is invalid", tt.window)
+			}
+			if got := mw.contains(tt.at); got != tt.want {
+				t.Errorf("contains(%s) = %v, want %v", tt.at.Format("Mon 15:04"), got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseMaintenanceWindowInvalid(t *testing.T) {
+	for _, value := range []string{"03:00", "03:00-25:00", "3am-5am", "03:00-05:00 someday", "03:00-05:00 sat sun"} {
+		t.Run(value, func(t *testing.T) {
+			if withSettings(t, nil, nil, func() { parseMaintenanceWindow(value) }) {
+				t.Errorf("parseMaintenanceWindow(%q) is valid", value)
+			}
+		})
+	}
+}
@@ -0,0 +1,345 @@
+package mediacache
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"git.hajkey.org/hajkey/mediacache/internal/cachekey"
+	"git.hajkey.org/hajkey/mediacache/internal/httpcond"
+)
+
+func joinUrl(base, path string) string {
+	return strings.TrimSuffix(base, "/") + "/" + strings.TrimPrefix(path, "/")
+}
+
+func sendPlain(w http.ResponseWriter, status int, message string) int64 {
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Content-Length", strconv.Itoa(len(message)))
+	w.WriteHeader(status)
+	bytes, _ := w.Write([]byte(message))
+	return int64(bytes)
+}
+
+// contentDisposition builds a Content-Disposition header naming the object
+// at key. Non-ASCII names get an RFC 8187 filename* parameter, with a
+// plain ASCII filename as a fallback for clients that don't support it.
+func contentDisposition(disposition string, key string) string {
+	name, _, _ := strings.Cut(key, "?")
+	name = path.Base(name)
+	if name == "/" || name == "." {
+		return disposition
+	}
+
+	var fallback, encoded strings.Builder
+	plain := true
+	for _, r := range name {
+		switch {
+		case r >= 0x80 || r < 0x20 || r == 0x7f:
+			plain = false
+			fallback.WriteByte('_')
+		case r == '"' || r == '\\':
+			fallback.WriteByte('_')
+		default:
+			fallback.WriteRune(r)
+		}
+	}
+	for _, b := range []byte(name) {
+		if isAttrChar(b) {
+			encoded.WriteByte(b)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", b)
+		}
+	}
+
+	header := fmt.Sprintf("%s; filename=\"%s\"", disposition, fallback.String())
+	if !plain {
+		header += "; filename*=UTF-8''" + encoded.String()
+	}
+	return header
+}
+
+// isAttrChar reports whether b may appear unencoded in an RFC 8187 value.
+func isAttrChar(b byte) bool {
+	switch {
+	case 'a' <= b && b <= 'z', 'A' <= b && b <= 'Z', '0' <= b && b <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$&+-.^_`|~", b) >= 0
+}
+
+func getHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("OK"))
+}
+
+func handleCache(w http.ResponseWriter, r *http.Request) {
+	var err error
+
+	// Get filename from URL
+	r = withOriginal(r)
+	filename := routeFor(r.Host, r.URL.Path).key(keyPolicy.Key(r.URL.Path, r.URL.RawQuery))
+	source := cachekey.UpstreamPath(r)
+
+	if filename == "/" {
+		getRoot(w, r)
+		return
+	}
+
+	if isLoop(r) {
+		logger.Printf("refusing request for `%s`, it has been through us before (Via: %s)", r.URL.RequestURI(), strings.Join(r.Header.Values("Via"), ", "))
+		http.Error(w, "loop detected", http.StatusLoopDetected)
+		stats.Errors++
+		return
+	}
+	r = withVia(r)
+
+	// Check for invalid characters
+	if strings.Contains(filename, "..") ||
+		strings.Contains(filename, "~") {
+		logger.Printf("error with request for `%s`, contains invalid character", filename)
+		http.Error(w, "invalid path", http.StatusBadRequest)
+		stats.Errors++
+		return
+	}
+
+	if isBlocked(filename) {
+		logger.Printf("refusing request for `%s`, blocklisted", filename)
+		if _, ok := sendPlaceholder(w, filename, http.StatusForbidden); !ok {
+			http.Error(w, "blocked", http.StatusForbidden)
+		}
+		return
+	}
+
+	// Acquire a read lock for the file
+	lock := getLock(filename)
+	lock.waiting.Add(1)
+	defer lock.waiting.Add(-1)
+	if !lock.RLockTimeout(lockTimeout) {
+		lockTimedOut(w, lock)
+		return
+	}
+	rLocked := true
+	defer func() {
+		if rLocked {
+			lock.RUnlock()
+		}
+		lock.Completed++
+		stats.Completed++
+	}()
+
+	var n int64
+	var corrupt bool
+
+	lock.Requests++
+	stats.Requests++
+
+	cond := httpcond.Parse(r)
+
+	// Check if file exists in ./cache
+	if memTier.Has(cachekey.Hash(filename)) || checkExists(filename) {
+		n, err = serveFile(w, r, filename, cond, "HIT")
+
+		// Client disconnected, ignore
+		disconnect := errors.Is(err, syscall.EPIPE)
+
+		if err == nil || disconnect {
+			lock.Hits++
+			stats.Hits++
+			lock.HitBytes += uint64(n)
+			stats.HitBytes += uint64(n)
+			lock.SentBytes += uint64(n)
+			stats.SentBytes += uint64(n)
+			return
+		}
+
+		if errors.Is(err, ErrSlowRead) {
+			logger.Printf("slow read serving %s: %v", filename, err)
+			lock.SlowReads++
+			stats.SlowReads++
+
+			// Headers are still unsent if nothing was written, so the
+			// request can be retried against the upstream
+			if n == 0 && slowReadFallback {
+				for header := range w.Header() {
+					w.Header().Del(header)
+				}
+				n, err = proxyFile(w, r, filename, source, "BYPASS")
+			}
+			if err != nil {
+				failRequest(w, &lock.Stats, err, n, "serving "+filename)
+				return
+			}
+			lock.SentBytes += uint64(n)
+			stats.SentBytes += uint64(n)
+			return
+		}
+
+		if errors.Is(err, ErrCorrupt) {
+			logger.Printf("corrupt object for %s, fetching it again: %v", filename, err)
+			lock.Corrupt++
+			stats.Corrupt++
+			corrupt = true
+		}
+	}
+
+	// Don't make clients wait for the whole file just to get a small part.
+	// HTTP/1.0 clients do wait, as only a cached object is sure to come with
+	// a Content-Length they can rely on. Objects the admission policy doesn't
+	// want cached yet are passed through as well.
+	missing := !checkExists(filename)
+	rangePass := rangePassthrough && r.Header.Get("Range") != "" && r.ProtoAtLeast(1, 1) && missing
+	admitted := !missing || admit(routeFor(r.Host, r.URL.Path), filename)
+	if rangePass || !admitted {
+		// Passthroughs pull from the upstreams just like fills do, so they
+		// are held to the same fetch slots and ingress cap
+		if !acquireFetchFor(r.Context(), fetchPriority(r)) {
+			logger.Printf("too many concurrent fetches, rejecting %s", filename)
+			lock.Limited++
+			stats.Limited++
+			sendTooMany(w, time.Second, "too many concurrent fetches")
+			return
+		}
+		if waitIngress(r.Context()) != nil {
+			releaseFetch()
+			lock.Disconnects++
+			stats.Disconnects++
+			return
+		}
+		n, err = proxyFile(w, r, filename, source, "PASS")
+		releaseFetch()
+		disconnect := errors.Is(err, syscall.EPIPE)
+		if err != nil && !disconnect {
+			failRequest(w, &lock.Stats, err, n, "passing through "+filename)
+		} else {
+			if disconnect {
+				lock.Disconnects++
+				stats.Disconnects++
+			} else {
+				lock.Misses++
+				stats.Misses++
+				lock.MissBytes += uint64(n)
+				stats.MissBytes += uint64(n)
+			}
+			lock.SentBytes += uint64(n)
+			stats.SentBytes += uint64(n)
+		}
+
+		if admitted && rangeBackgroundFill {
+			fillInBackground(filename, source)
+		}
+		return
+	}
+
+	if !acquireFetchFor(r.Context(), fetchPriority(r)) {
+		logger.Printf("too many concurrent fetches, rejecting %s", filename)
+		lock.Limited++
+		stats.Limited++
+		sendTooMany(w, time.Second, "too many concurrent fetches")
+		return
+	}
+	release := sync.OnceFunc(releaseFetch)
+	defer release()
+
+	lock.RUnlock()
+	rLocked = false
+	if !lock.LockTimeout(lockTimeout) {
+		lockTimedOut(w, lock)
+		return
+	}
+
+	if corrupt {
+		_ = removeObject(cachekey.Hash(filename))
+	}
+
+	fillCtx, stopFill := fillContext(r, lock)
+	if !checkExists(filename) {
+		// File does not exist in cache, fetch it
+		n, err = fetchFile(fillCtx, filename, source)
+		if err == nil {
+			journalMiss(routeFor(r.Host, r.URL.Path).key(source))
+		}
+	} else {
+		// File may have expired, revalidate it
+		n, err = revalidateFile(fillCtx, filename, source)
+	}
+	stopFill()
+
+	// Nobody left to send it to
+	if r.Context().Err() != nil {
+		logger.Printf("client went away while fetching %s (%s): %v", filename, disconnectPolicy, err)
+		lock.Abandoned++
+		stats.Abandoned++
+		lock.Disconnects++
+		stats.Disconnects++
+		lock.Unlock()
+		return
+	}
+	if errors.Is(err, ErrTooLarge) && oversizePolicy == "passthrough" {
+		lock.Unlock()
+		n, err = proxyFile(w, r, filename, source, "PASS")
+		disconnect := errors.Is(err, syscall.EPIPE)
+		if err != nil && !disconnect {
+			failRequest(w, &lock.Stats, err, n, "passing through oversized "+filename)
+			return
+		}
+		if disconnect {
+			lock.Disconnects++
+			stats.Disconnects++
+		} else {
+			lock.Misses++
+			stats.Misses++
+			lock.MissBytes += uint64(n)
+			stats.MissBytes += uint64(n)
+		}
+		lock.SentBytes += uint64(n)
+		stats.SentBytes += uint64(n)
+		return
+	}
+	if err != nil {
+		failRequest(w, &lock.Stats, err, n, "fetching "+filename)
+		lock.Unlock()
+		return
+	}
+
+	lock.Unlock()
+	release()
+	if !lock.RLockTimeout(lockTimeout) {
+		lockTimedOut(w, lock)
+		return
+	}
+	rLocked = true
+
+	// Serve the file
+	n, err = serveFile(w, r, filename, cond, "MISS")
+
+	// Client disconnected, ignore
+	disconnect := errors.Is(err, syscall.EPIPE)
+
+	if err != nil && !disconnect {
+		if errors.Is(err, ErrSlowRead) {
+			lock.SlowReads++
+			stats.SlowReads++
+		}
+		failRequest(w, &lock.Stats, err, n, "serving "+filename)
+		return
+	}
+
+	if disconnect {
+		lock.Disconnects++
+		stats.Disconnects++
+		lock.SentBytes += uint64(n)
+		stats.SentBytes += uint64(n)
+	}
+	lock.Misses++
+	stats.Misses++
+	lock.MissBytes += uint64(n)
+	stats.MissBytes += uint64(n)
+	lock.SentBytes += uint64(n)
+	stats.SentBytes += uint64(n)
+}
@@ -0,0 +1,131 @@
+package mediacache
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// get requests target from srv exactly as written and reads the whole
+// response, which has to be a 200.
+func get(t *testing.T, srv *httptest.Server, target string) (*http.Response, string) {
+	t.Helper()
+	resp, err := srv.Client().Get(srv.URL + target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s: status = %d, want %d", target, resp.StatusCode, http.StatusOK)
+	}
+	return resp, string(body)
+}
+
+func TestEncodedNamesRoundTrip(t *testing.T) {
+	srv := httptest.NewServer(testCache)
+	defer srv.Close()
+
+	tests := []struct {
+		name    string
+		target  string
+		decoded string
+	}{
+		{"encoded slash", "/a%2Fb.png", "/a/b.png"},
+		{"encoded percent", "/100%25.png", "/100%.png"},
+		{"space", "/a%20b.png", "/a b.png"},
+		{"utf-8", "/caf%C3%A9.png", "/café.png"},
+		{"not utf-8", "/%FF.png", "/\xff.png"},
+		{"query", "/caf%C3%A9.png?w=1", "/café.png?w=1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The upstream echoes what it was asked for, so the body
+			// shows whether the name reached it intact
+			_, body := get(t, srv, tt.target)
+			if body != tt.target {
+				t.Fatalf("upstream got %q, want %q", body, tt.target)
+			}
+
+			resp, body := get(t, srv, tt.target)
+			if !strings.Contains(resp.Header.Get("X-Cache"), "HIT") {
+				t.Errorf("X-Cache = %q on the second request, want a hit", resp.Header.Get("X-Cache"))
+			}
+			if body != tt.target {
+				t.Errorf("cached body = %q, want %q", body, tt.target)
+			}
+
+			// Purging works both with the name as it appears in URLs and
+			// with the key it is stored under
+			for _, name := range []string{tt.target, tt.decoded} {
+				err := testCache.Purge(name)
+				if err != nil {
+					t.Fatalf("Purge(%q) error = %v", name, err)
+				}
+				resp, _ = get(t, srv, tt.target)
+				if !strings.Contains(resp.Header.Get("X-Cache"), "MISS") {
+					t.Errorf("X-Cache = %q after Purge(%q), want a miss", resp.Header.Get("X-Cache"), name)
+				}
+			}
+		})
+	}
+}
+
+func TestContentDisposition(t *testing.T) {
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"/a.svg", `attachment; filename="a.svg"`},
+		{"/dir/a.svg?w=1", `attachment; filename="a.svg"`},
+		{"/café.svg", `attachment; filename="caf_.svg"; filename*=UTF-8''caf%C3%A9.svg`},
+		{"/100%.svg", `attachment; filename="100%.svg"`},
+		{"/a b.svg", `attachment; filename="a b.svg"`},
+		{`/"a\b".svg`, `attachment; filename="_a_b_.svg"`},
+		{"/\xff.svg", `attachment; filename="_.svg"; filename*=UTF-8''%FF.svg`},
+		{"/", "attachment"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			if got := contentDisposition("attachment", tt.key); got != tt.want {
+				t.Errorf("contentDisposition() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestContentDispositionRoundTrip(t *testing.T) {
+	srv := httptest.NewServer(testCache)
+	defer srv.Close()
+
+	// Admission remembers names, so each run needs a new one
+	unique := strconv.FormatInt(time.Now().UnixNano(), 36)
+
+	tests := []struct {
+		name   string
+		target string
+		want   string
+	}{
+		{"cached", "/caf%C3%A9.svg", `attachment; filename="caf_.svg"; filename*=UTF-8''caf%C3%A9.svg`},
+		{
+			"passed through",
+			"/pass/" + unique + "-caf%C3%A9.svg",
+			`attachment; filename="` + unique + `-caf_.svg"; filename*=UTF-8''` + unique + "-caf%C3%A9.svg",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, _ := get(t, srv, tt.target)
+			if got := resp.Header.Get("Content-Disposition"); got != tt.want {
+				t.Errorf("Content-Disposition = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
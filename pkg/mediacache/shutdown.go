@@ -0,0 +1,72 @@
+package mediacache
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// fetchCtx is cancelled when shutdown gives up on draining, aborting every
+// upstream transfer still in progress. fills tracks cache writes, so we can
+// wait for aborted ones to clean up after themselves before exiting.
+var (
+	fetchCtx, abortFetches = context.WithCancel(context.Background())
+	fills                  sync.WaitGroup
+)
+
+// runServer serves until SIGTERM or SIGINT, then stops accepting requests
+// and gives in-flight ones up to shutdownTimeout to finish.
+func runServer(srv *http.Server, run func() error) error {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- run()
+	}()
+
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+	}
+	stop()
+
+	logger.Printf("shutting down, draining requests for up to %s", shutdownTimeout)
+	drainCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	err := srv.Shutdown(drainCtx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		logger.Print("drain timed out, aborting remaining transfers")
+		abortFetches()
+		_ = srv.Close()
+	} else if err != nil {
+		logger.Printf("error shutting down: %v", err)
+	}
+
+	// Partially written files are removed by the fills themselves
+	done := make(chan struct{})
+	go func() {
+		fills.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		logger.Print("gave up waiting for aborted fills to clean up")
+	}
+
+	index.Save()
+	if printStats {
+		stats.Report(" (final)")
+	}
+	reportRoutes()
+	reportUpstream()
+	logger.Print("shutdown complete")
+	return nil
+}
@@ -0,0 +1,58 @@
+package mediacache
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func sign(key string, pathAndQuery string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(pathAndQuery))
+	return pathAndQuery + "&signature=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestSignatureMiddleware(t *testing.T) {
+	signingKey = "secret"
+	defer func() { signingKey = "" }()
+
+	expires := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	expired := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+
+	tests := []struct {
+		name   string
+		target string
+		status int
+		query  string
+	}{
+		{"signed", sign("secret", "/a.png?w=400&expires="+expires), http.StatusOK, "w=400"},
+		{"query kept as sent", sign("secret", "/a.png?q=a%20b+c&x=%2F&expires="+expires), http.StatusOK, "q=a%20b+c&x=%2F"},
+		{"only expires", sign("secret", "/a.png?expires="+expires), http.StatusOK, ""},
+		{"wrong key", sign("other", "/a.png?expires="+expires), http.StatusForbidden, ""},
+		{"expired", sign("secret", "/a.png?expires="+expired), http.StatusForbidden, ""},
+		{"unsigned", "/a.png?expires=" + expires, http.StatusForbidden, ""},
+		{"landing page", "/", http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var query string
+			handler := withSignature(func(w http.ResponseWriter, r *http.Request) {
+				query = r.URL.RawQuery
+			})
+
+			w := httptest.NewRecorder()
+			handler(w, httptest.NewRequest("GET", tt.target, nil))
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d", w.Code, tt.status)
+			}
+			if tt.status == http.StatusOK && query != tt.query {
+				t.Errorf("query = %q, want %q", query, tt.query)
+			}
+		})
+	}
+}
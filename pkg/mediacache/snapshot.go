@@ -0,0 +1,122 @@
+package mediacache
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A snapshot hard links the whole cache directory into a new directory
+// under CACHE_SNAPSHOT_DIR, which has to be on the same filesystem. Fills
+// keep downloading meanwhile, but wait to put their object and its
+// metadata in place, so every object in the snapshot comes with its
+// metadata; files are never rewritten in place, so the snapshot stays as
+// it was once the cache moves on. Back it up at leisure, then delete it.
+// Only disk storage supports snapshots.
+var snapshotDir string
+
+func configureSnapshot() {
+	snapshotDir = getEnv("CACHE_SNAPSHOT_DIR", "")
+}
+
+// fillGate is held for reading by fills while they put an object and its
+// metadata in place, and for writing while a snapshot is taken.
+var (
+	fillGate   sync.RWMutex
+	snapshotMu sync.Mutex
+)
+
+type snapshotResult struct {
+	Path     string  `json:"path"`
+	Files    int     `json:"files"`
+	PausedMs float64 `json:"pausedMs"`
+}
+
+func takeSnapshot() (result snapshotResult, err error) {
+	if snapshotDir == "" {
+		return result, errors.New("CACHE_SNAPSHOT_DIR is not set")
+	}
+	if storageKind != "disk" {
+		return result, fmt.Errorf("snapshots are not supported with %s storage", storageKind)
+	}
+
+	snapshotMu.Lock()
+	defer snapshotMu.Unlock()
+
+	result.Path = filepath.Join(snapshotDir, time.Now().UTC().Format("20060102T150405Z"))
+	src, err := filepath.Abs(cacheDir)
+	if err != nil {
+		return result, err
+	}
+	root, err := filepath.Abs(snapshotDir)
+	if err != nil {
+		return result, err
+	}
+	dst := filepath.Join(root, filepath.Base(result.Path))
+	err = os.MkdirAll(dst, 0755)
+	if err != nil {
+		return result, err
+	}
+
+	started := time.Now()
+	fillGate.Lock()
+	defer func() {
+		fillGate.Unlock()
+		result.PausedMs = float64(time.Since(started).Microseconds()) / 1000
+	}()
+
+	err = filepath.WalkDir(src, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		// The snapshots may well live inside the cache directory
+		if entry.IsDir() && path == root {
+			return filepath.SkipDir
+		}
+		if strings.HasSuffix(path, ".tmp") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if entry.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		err = os.Link(path, target)
+		if errors.Is(err, fs.ErrNotExist) {
+			// Removed since the directory was read
+			return nil
+		}
+		if err == nil {
+			result.Files++
+		}
+		return err
+	})
+	return result, err
+}
+
+func postAdminSnapshot(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	result, err := takeSnapshot()
+	if err != nil {
+		logger.Printf("error taking snapshot: %v", err)
+		http.Error(w, "error taking snapshot", http.StatusInternalServerError)
+		return
+	}
+	logger.Printf("snapshot %s: %d files, fills paused for %.1fms", result.Path, result.Files, result.PausedMs)
+
+	sendJSON(w, result)
+}
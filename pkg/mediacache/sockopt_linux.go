@@ -0,0 +1,25 @@
+package mediacache
+
+import (
+	"net"
+	"syscall"
+)
+
+// Not in the syscall package, see linux/tcp.h
+const tcpNotSentLowatOpt = 25
+
+func setNotSentLowat(conn *net.TCPConn, bytes int) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpNotSentLowatOpt, bytes)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package mediacache
+
+import (
+	"net"
+)
+
+const ErrSockoptUnsupported = ErrorStr("not supported on this platform")
+
+func setNotSentLowat(conn *net.TCPConn, bytes int) error {
+	return ErrSockoptUnsupported
+}
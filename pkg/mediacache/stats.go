@@ -0,0 +1,10 @@
+package mediacache
+
+import (
+	mcstats "git.hajkey.org/hajkey/mediacache/internal/stats"
+)
+
+// Stats are kept in total, per object and per route, see the stats package.
+type Stats = mcstats.Stats
+
+var stats Stats = Stats{Name: "TOTALS"}
@@ -0,0 +1,40 @@
+package mediacache
+
+import (
+	"git.hajkey.org/hajkey/mediacache/internal/store"
+)
+
+// CACHE_DIR_LAYOUT is sharded or flat, see store.NewDisk.
+var dirLayout string
+
+func configureStorage() {
+	dirLayout = getEnv("CACHE_DIR_LAYOUT", "sharded")
+
+	switch storageKind {
+	case "disk", "", "s3":
+	default:
+		invalidConfig("invalid value for CACHE_STORAGE: %s", storageKind)
+	}
+	checkDirLayout(dirLayout)
+}
+
+func checkDirLayout(layout string) bool {
+	switch layout {
+	case "sharded":
+		return true
+	case "flat":
+		return false
+	}
+	invalidConfig("invalid value for CACHE_DIR_LAYOUT: %s", layout)
+	return false
+}
+
+func newStorage(kind string) store.Storage {
+	switch kind {
+	case "disk", "":
+		return withChaos(store.NewDisk(cacheDir, checkDirLayout(dirLayout)))
+	case "s3":
+		return withChaos(newS3Storage())
+	}
+	return nil
+}
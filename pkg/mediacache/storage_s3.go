@@ -0,0 +1,81 @@
+package mediacache
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"git.hajkey.org/hajkey/mediacache/internal/store"
+)
+
+var (
+	s3Endpoint  string
+	s3Bucket    string
+	s3Region    string
+	s3AccessKey string
+	s3SecretKey string
+	s3Prefix    string
+	s3PathStyle bool
+	s3Timeout   time.Duration
+)
+
+func configureS3() {
+	s3Endpoint = getEnv("CACHE_S3_ENDPOINT", "https://s3.amazonaws.com")
+	s3Bucket = getEnv("CACHE_S3_BUCKET", "")
+	s3Region = getEnv("CACHE_S3_REGION", "us-east-1")
+	s3AccessKey = getEnv("CACHE_S3_ACCESS_KEY", "")
+	s3SecretKey = getEnv("CACHE_S3_SECRET_KEY", "")
+	s3Prefix = getEnv("CACHE_S3_PREFIX", "")
+	s3PathStyle = getEnv("CACHE_S3_PATH_STYLE", true)
+	s3Timeout = getDuration("CACHE_S3_TIMEOUT", "CACHE_S3_TIMEOUT_SECONDS", time.Second, 30*time.Second)
+}
+
+// newS3Storage keeps objects in an S3-compatible bucket, so that several
+// replicas can share one cache.
+func newS3Storage() store.Storage {
+	if s3Bucket == "" {
+		invalidConfig("CACHE_S3_BUCKET is required for s3 storage")
+		return nil
+	}
+
+	endpoint, err := url.Parse(s3Endpoint)
+	if err != nil {
+		invalidConfig("invalid value for CACHE_S3_ENDPOINT: %v", err)
+		return nil
+	}
+
+	return store.NewS3(store.S3Config{
+		Endpoint:  endpoint,
+		Bucket:    s3Bucket,
+		Region:    s3Region,
+		AccessKey: s3AccessKey,
+		SecretKey: s3SecretKey,
+		Prefix:    s3Prefix,
+		PathStyle: s3PathStyle,
+		Client:    newS3Client(),
+		Timeout:   s3Timeout,
+	})
+}
+
+// newS3Client is the bucket's own client. The upstream client's redirect
+// policy and Via handling are for upstreams, and its timeouts are sized for
+// them; a bucket that stops answering should fail within CACHE_S3_TIMEOUT.
+// Redirects from S3 mean a wrong region or endpoint, so they are returned
+// as errors instead of followed.
+func newS3Client() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	dialer := &net.Dialer{
+		Timeout:   s3Timeout,
+		KeepAlive: 30 * time.Second,
+	}
+	transport.DialContext = dialer.DialContext
+	transport.TLSHandshakeTimeout = s3Timeout
+	transport.ResponseHeaderTimeout = s3Timeout
+	return &http.Client{
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
@@ -0,0 +1,95 @@
+package mediacache
+
+import (
+	"mime"
+	"net/http"
+	"strings"
+)
+
+const svgContentType = "image/svg+xml"
+
+// SVGs can carry scripts, so they are never served as plain active content
+// under our domain. The policy decides how they are defused:
+//
+//   - sandbox: serve inline with a CSP that forbids scripts and embedding
+//   - attachment: force a download via Content-Disposition
+//   - none: serve as-is
+var (
+	svgPolicy string
+	svgRoutes []svgRoute
+)
+
+func configureSvg() {
+	svgPolicy = checkSvgPolicy(getEnv("CACHE_SVG_POLICY", "sandbox"))
+	svgRoutes = parseSvgRoutes(getEnv("CACHE_SVG_ROUTES", ""))
+}
+
+type svgRoute struct {
+	prefix string
+	policy string
+}
+
+// parseSvgRoutes reads space-separated prefix=policy pairs, e.g.
+// "/emoji=sandbox /attachments=attachment".
+func parseSvgRoutes(value string) (routes []svgRoute) {
+	for _, entry := range strings.Fields(value) {
+		prefix, policy, ok := strings.Cut(entry, "=")
+		if !ok || !validSvgPolicy(policy) {
+			invalidConfig("invalid value for CACHE_SVG_ROUTES: %s", entry)
+			continue
+		}
+		routes = append(routes, svgRoute{prefix: prefix, policy: policy})
+	}
+	return routes
+}
+
+func checkSvgPolicy(policy string) string {
+	if !validSvgPolicy(policy) {
+		invalidConfig("invalid value for CACHE_SVG_POLICY: %s", policy)
+	}
+	return policy
+}
+
+func validSvgPolicy(policy string) bool {
+	switch policy {
+	case "sandbox", "attachment", "none":
+		return true
+	}
+	return false
+}
+
+func svgPolicyFor(filename string) string {
+	policy := svgPolicy
+	longest := -1
+	for _, route := range svgRoutes {
+		if strings.HasPrefix(filename, route.prefix) && len(route.prefix) > longest {
+			policy = route.policy
+			longest = len(route.prefix)
+		}
+	}
+	return policy
+}
+
+func isSvg(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = strings.ToLower(strings.TrimSpace(contentType))
+	}
+	return mediaType == svgContentType
+}
+
+// secureSvg adds the protective headers for SVG responses.
+func secureSvg(w http.ResponseWriter, filename string, contentType string) {
+	if !isSvg(contentType) {
+		return
+	}
+
+	switch svgPolicyFor(filename) {
+	case "sandbox":
+		w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; sandbox")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+	case "attachment":
+		w.Header().Set("Content-Disposition", contentDisposition("attachment", filename))
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+	}
+}
@@ -0,0 +1,72 @@
+package mediacache
+
+import (
+	"net"
+	"sync"
+)
+
+// Socket options for client connections. Large media streams over
+// high-latency links benefit from bigger send buffers and from keeping
+// unsent data in the kernel small, so the stream can react to congestion
+// quickly. Zero leaves the OS default.
+var (
+	tcpNoDelay      bool
+	tcpSendBuffer   int
+	tcpNotSentLowat int
+)
+
+func configureTCP() {
+	tcpNoDelay = getEnv("CACHE_TCP_NODELAY", true)
+	tcpSendBuffer = int(getSize("CACHE_TCP_SEND_BUFFER", "CACHE_TCP_SEND_BUFFER_KB", 1<<10, 0))
+	tcpNotSentLowat = int(getSize("CACHE_TCP_NOTSENT_LOWAT", "CACHE_TCP_NOTSENT_LOWAT_KB", 1<<10, 0))
+}
+
+// Failing to set TCP_NOTSENT_LOWAT usually means it is unsupported rather
+// than a problem with one connection, so it is only reported once.
+var notSentLowatWarning sync.Once
+
+// tunedListener applies the socket options to every accepted connection.
+type tunedListener struct {
+	*net.TCPListener
+}
+
+func (l tunedListener) Accept() (net.Conn, error) {
+	conn, err := l.AcceptTCP()
+	if err != nil {
+		return nil, err
+	}
+	tuneConn(conn)
+	return conn, nil
+}
+
+func tuneConn(conn *net.TCPConn) {
+	err := conn.SetNoDelay(tcpNoDelay)
+	if err != nil {
+		logger.Printf("error setting TCP_NODELAY: %v", err)
+	}
+
+	if tcpSendBuffer > 0 {
+		err = conn.SetWriteBuffer(tcpSendBuffer)
+		if err != nil {
+			logger.Printf("error setting send buffer: %v", err)
+		}
+	}
+
+	if tcpNotSentLowat > 0 {
+		err = setNotSentLowat(conn, tcpNotSentLowat)
+		if err != nil {
+			notSentLowatWarning.Do(func() {
+				logger.Printf("error setting TCP_NOTSENT_LOWAT: %v", err)
+			})
+		}
+	}
+}
+
+// listenTCP opens the TCP listener with the configured socket options.
+func listenTCP(addr string) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return tunedListener{ln.(*net.TCPListener)}, nil
+}
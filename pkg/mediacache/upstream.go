@@ -0,0 +1,250 @@
+package mediacache
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const leakThreshold = 10 * time.Minute
+
+var ErrUpstreamIdle error = classedError{ErrUpstreamTimeout, "upstream stalled"}
+
+// There is deliberately no overall timeout: large files may take as long as
+// they need, as long as they keep making progress. Headers have to arrive
+// within upstreamHeaderTimeout and the body may not stall for longer than
+// upstreamIdleTimeout.
+var httpClient *http.Client
+
+func configureUpstream() {
+	httpClient = &http.Client{
+		Transport:     newUpstreamTransport(),
+		CheckRedirect: checkRedirect,
+	}
+}
+
+// upstreamStats counts upstream connection usage. Unlike Stats, these are
+// updated from transport callbacks, so they are atomic.
+var upstreamStats struct {
+	open     atomic.Int64
+	dialed   atomic.Uint64
+	reused   atomic.Uint64
+	idle     atomic.Uint64
+	inFlight atomic.Int64
+	leaked   atomic.Uint64
+	received atomic.Uint64
+}
+
+type trackedBody struct {
+	io.ReadCloser
+
+	url     string
+	opened  time.Time
+	stack   []byte
+	once    sync.Once
+	flagged bool
+
+	idle    *time.Timer
+	stalled atomic.Bool
+	cancel  context.CancelFunc
+}
+
+var (
+	bodies   = make(map[*trackedBody]struct{})
+	bodiesMu sync.Mutex
+)
+
+type countedConn struct {
+	net.Conn
+	once sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(func() {
+		upstreamStats.open.Add(-1)
+	})
+	return c.Conn.Close()
+}
+
+func newUpstreamTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = upstreamHeaderTimeout
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		upstreamStats.open.Add(1)
+		upstreamStats.dialed.Add(1)
+		return &countedConn{Conn: conn}, nil
+	}
+	return transport
+}
+
+// upstreamGet is upstreamDo for a plain GET.
+func upstreamGet(url string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return upstreamDo(req)
+}
+
+// upstreamDo performs an upstream request, recording whether the connection
+// was reused and tracking the response body until it is closed.
+func upstreamDo(req *http.Request) (*http.Response, error) {
+	err := injectFetchFault(req.Context())
+	if err != nil {
+		return nil, upstreamError(err)
+	}
+
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				upstreamStats.reused.Add(1)
+			}
+			if info.WasIdle {
+				upstreamStats.idle.Add(1)
+			}
+		},
+	}
+	ctx, cancel := context.WithCancel(req.Context())
+	stopAbort := context.AfterFunc(fetchCtx, cancel)
+	req = req.WithContext(httptrace.WithClientTrace(ctx, trace))
+	req.Header.Set("Via", viaHeader(ctx))
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		stopAbort()
+		cancel()
+		return nil, upstreamError(err)
+	}
+
+	body := &trackedBody{
+		ReadCloser: resp.Body,
+		url:        req.URL.String(),
+		opened:     time.Now(),
+		cancel: func() {
+			stopAbort()
+			cancel()
+		},
+	}
+	if upstreamIdleTimeout > 0 {
+		body.idle = time.AfterFunc(upstreamIdleTimeout, func() {
+			body.stalled.Store(true)
+			cancel()
+		})
+	}
+	if debugMode {
+		body.stack = debug.Stack()
+	}
+
+	bodiesMu.Lock()
+	bodies[body] = struct{}{}
+	bodiesMu.Unlock()
+	upstreamStats.inFlight.Add(1)
+
+	resp.Body = body
+	return resp, nil
+}
+
+func (b *trackedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	upstreamStats.received.Add(uint64(n))
+	if b.stalled.Load() {
+		return n, ErrUpstreamIdle
+	}
+	if n > 0 && b.idle != nil {
+		b.idle.Reset(upstreamIdleTimeout)
+	}
+	return n, err
+}
+
+func (b *trackedBody) Close() error {
+	b.once.Do(func() {
+		if b.idle != nil {
+			b.idle.Stop()
+		}
+		defer b.cancel()
+
+		bodiesMu.Lock()
+		delete(bodies, b)
+		bodiesMu.Unlock()
+		upstreamStats.inFlight.Add(-1)
+	})
+	return b.ReadCloser.Close()
+}
+
+// checkLeaks reports response bodies that have been open suspiciously long,
+// which usually means a code path forgot to close them.
+func checkLeaks() {
+	bodiesMu.Lock()
+	defer bodiesMu.Unlock()
+
+	for body := range bodies {
+		if body.flagged || time.Since(body.opened) < leakThreshold {
+			continue
+		}
+		body.flagged = true
+		upstreamStats.leaked.Add(1)
+
+		logger.Printf("possible leaked upstream response body: %s (open %s)", body.url, time.Since(body.opened).Round(time.Second))
+		if body.stack != nil {
+			logger.Printf("opened at:\n%s", body.stack)
+		}
+	}
+}
+
+func reportUpstream() {
+	if !printStats {
+		return
+	}
+
+	logger.Printf(
+		"UPSTREAM\n"+
+			"conn: %4d open  %6d dialed  %6d reused (%d idle)\n"+
+			"body: %4d open  %6d leaked",
+		upstreamStats.open.Load(),
+		upstreamStats.dialed.Load(),
+		upstreamStats.reused.Load(),
+		upstreamStats.idle.Load(),
+		upstreamStats.inFlight.Load(),
+		upstreamStats.leaked.Load(),
+	)
+	if maxIngress > 0 {
+		logger.Printf(
+			"ingress: %.1f/%dMB/s  queued: %d now, %d total, %s waited",
+			float64(ingressStats.rate.Load())/1024/1024, maxIngress/1024/1024,
+			ingressStats.waiting.Load(), ingressStats.queued.Load(),
+			time.Duration(ingressStats.queuedNanos.Load()).Round(time.Millisecond),
+		)
+	}
+
+	for _, upstream := range allUpstreams() {
+		state := "up"
+		if !upstream.healthy() {
+			state = "DOWN"
+		}
+		upstream.mu.Lock()
+		latency := upstream.latency
+		upstream.mu.Unlock()
+
+		logger.Printf(
+			"%s %s\n"+
+				"req: %6d  err: %6d  latency: %s",
+			upstream.url, state,
+			upstream.requests.Load(), upstream.errors.Load(),
+			latency.Round(time.Millisecond),
+		)
+	}
+}